@@ -0,0 +1,16 @@
+package config
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func NewConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the node OS config format",
+	}
+	cmd.AddCommand(
+		NewSchemaCommand(),
+	)
+	return cmd
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"github.com/psviderski/homecloud/cmd/hc/cluster"
+	"github.com/psviderski/homecloud/cmd/hc/config"
+	"github.com/psviderski/homecloud/cmd/hc/netboot"
 	"github.com/psviderski/homecloud/cmd/hc/node"
 	"github.com/psviderski/homecloud/internal/client"
 	"github.com/spf13/cobra"
@@ -18,6 +20,8 @@ func main() {
 	cobra.CheckErr(err)
 	app.AddCommand(
 		cluster.NewClusterCommand(c),
+		config.NewConfigCommand(),
+		netboot.NewNetbootCommand(c),
 		node.NewNodeCommand(c),
 	)
 	cobra.CheckErr(app.Execute())
@@ -0,0 +1,17 @@
+package netboot
+
+import (
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewNetbootCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "netboot",
+		Short: "Boot diskless nodes over the network",
+	}
+	cmd.AddCommand(
+		NewServeCommand(c),
+	)
+	return cmd
+}
@@ -0,0 +1,110 @@
+package netboot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/psviderski/homecloud/internal/netboot"
+	"github.com/spf13/cobra"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+type serveOptions struct {
+	cluster  string
+	bootDir  string
+	image    string
+	tftpAddr string
+	httpAddr string
+}
+
+func NewServeCommand(c *client.Client) *cobra.Command {
+	opts := serveOptions{}
+	cmd := &cobra.Command{
+		Use:   "serve -c CLUSTER_NAME --boot-dir DIR",
+		Short: "Run TFTP and HTTP servers for booting Raspberry Pi 4 nodes over the network",
+		Long: "Run TFTP and HTTP servers that serve the Raspberry Pi 4 boot files, the Home Cloud OS image, and " +
+			"the OS config of every node in the cluster identified by its serial number or MAC address " +
+			"(see --serial and --mac flags of `hc node rpi4 create`).\n\n" +
+			"TFTP: SERIAL/hcos.yaml returns the node config, other files are served from the boot directory.\n" +
+			"HTTP: /boot/PATH, /image, and /config/SERIAL_OR_MAC.\n\n" +
+			"The secrets in the node configs are sealed to the node keys that are not served, so the nodes can't " +
+			"unseal them until the keys are pushed with `hc node push-key` after the first boot. Configs of nodes " +
+			"created before the keys were introduced are sealed to newly generated keys.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serve(c, opts)
+		},
+	}
+	cmd.Flags().StringVarP(&opts.cluster, "cluster", "c", "", "Kubernetes cluster name")
+	_ = cmd.MarkFlagRequired("cluster")
+	cmd.Flags().StringVar(&opts.bootDir, "boot-dir", "",
+		"Directory with the Raspberry Pi 4 boot files (the content of the HCOS_BOOT partition of the image)")
+	_ = cmd.MarkFlagRequired("boot-dir")
+	cmd.Flags().StringVar(&opts.image, "image", "", "Path to the Home Cloud OS image to serve over HTTP")
+	cmd.Flags().StringVar(&opts.tftpAddr, "tftp-addr", ":69", "Address to listen on for TFTP requests")
+	cmd.Flags().StringVar(&opts.httpAddr, "http-addr", ":8080", "Address to listen on for HTTP requests")
+	return cmd
+}
+
+func serve(c *client.Client, opts serveOptions) error {
+	if _, err := c.GetCluster(opts.cluster); err != nil {
+		return err
+	}
+	if info, err := os.Stat(opts.bootDir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("boot directory %q is not a directory", opts.bootDir)
+	}
+	if opts.image != "" {
+		if _, err := os.Stat(opts.image); err != nil {
+			return err
+		}
+	}
+	// Serialise the config requests as sealing the config of a node without a key generates and saves one.
+	var mu sync.Mutex
+	s := &netboot.Server{
+		BootDir: opts.bootDir,
+		Image:   opts.image,
+		Config: func(id string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			node, err := c.GetNodeByBootID(opts.cluster, id)
+			if err != nil {
+				var notFound *client.ErrNotFound
+				if errors.As(err, &notFound) {
+					return nil, fmt.Errorf("%w: %s", fs.ErrNotExist, err)
+				}
+				return nil, err
+			}
+			return c.SealedOSConfig(node)
+		},
+	}
+
+	tftpConn, err := net.ListenPacket("udp", opts.tftpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for TFTP requests: %w", err)
+	}
+	httpListener, err := net.Listen("tcp", opts.httpAddr)
+	if err != nil {
+		_ = tftpConn.Close()
+		return fmt.Errorf("failed to listen for HTTP requests: %w", err)
+	}
+	fmt.Printf("Serving TFTP on %s and HTTP on %s for cluster %s.\n",
+		tftpConn.LocalAddr(), httpListener.Addr(), opts.cluster)
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- s.ServeTFTP(tftpConn)
+	}()
+	go func() {
+		errCh <- http.Serve(httpListener, s.HTTPHandler())
+	}()
+	err = <-errCh
+	_ = tftpConn.Close()
+	_ = httpListener.Close()
+	return err
+}
@@ -0,0 +1,38 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewAdoptCommand(c *client.Client) *cobra.Command {
+	req := client.AdoptRequest{}
+	cmd := &cobra.Command{
+		Use:   "adopt NAME --host [USER@]HOST[:PORT] [-c CLUSTER_NAME]",
+		Short: "Add a running node that is not managed by hc to a Kubernetes cluster",
+		Long: "Connect to a running node over SSH, verify that it belongs to the cluster, and add it to the list " +
+			"of cluster nodes. This is useful for nodes installed manually, e.g. with Raspberry Pi Imager, or " +
+			"if the local store has been lost.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			node, err := c.AdoptNode(req)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Node %s (provider: %s, role: %s) has been adopted.\n", node.Name, node.Provider, node.Role())
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&req.Host, "host", "",
+		"Host to connect to over SSH in the [user@]host[:port] format (default user is hc)")
+	_ = cmd.MarkFlagRequired("host")
+	cmd.Flags().StringVar(&req.SSHKey, "ssh-key", "",
+		"Path to the SSH private key to connect to the host with (default is the cluster SSH key)")
+	return cmd
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/cmd/hc/prompt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// NewCreateCommand creates a command for creating nodes using the provider. Provider specific options are exposed
+// as flags with the same names.
+func NewCreateCommand(c *client.Client, p client.Provider) *cobra.Command {
+	info := p.Describe()
+	req := client.NodeRequest{}
+	var wifi []string
+	var passwordPrompt bool
+	options := make(map[string]*string, len(info.Options))
+	cmd := &cobra.Command{
+		Use:   "create NAME [-c CLUSTER_NAME]",
+		Short: fmt.Sprintf("Create a new %s node for a Kubernetes cluster", info.Title),
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// TODO: generate a unique name for the node and make NAME optional.
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			if req.Password, err = readPassword(req.Password, passwordPrompt); err != nil {
+				return err
+			}
+			if wifi, err = prompt.WifiPasswords(wifi); err != nil {
+				return err
+			}
+			req.Wifi = client.ParseWifiNetworks(wifi)
+			req.Options = make(map[string]string, len(options))
+			for name, value := range options {
+				req.Options[name] = *value
+			}
+			node, err := c.CreateNode(info.Name, req)
+			if err != nil {
+				return err
+			}
+			// Print to stderr as providers can write the node artifacts to stdout, e.g. cloud-init user-data.
+			fmt.Fprintf(os.Stderr, "%s node %s has been created.\n", info.Title, node.Name)
+			// VM nodes get the node key on a key drive attached along with the config drive.
+			if node.SecretKey != nil && node.Provider != client.VMProvider {
+				fmt.Fprintf(os.Stderr, "The secrets in the node OS config are sealed to the node key. Write the "+
+					"key to a removable medium to attach to the node for the first boot (required if the node "+
+					"connects over Wi-Fi only):\n  hc node write-key %[1]s -c %[2]s --disk DEVICE [--format]\n"+
+					"or push it over SSH after the first boot if the node has a wired connection:\n"+
+					"  hc node push-key %[1]s -c %[2]s --host ADDRESS\n", node.Name, node.ClusterName)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&req.ControlPlane, "control-plane", false,
+		"Create a control plane node for the cluster (default is create a worker node)")
+	cmd.Flags().StringVar(&req.TailscaleAuthKey, "ts-auth-key", "",
+		"Tailscale auth key for registering the node in a tailnet")
+	_ = cmd.MarkFlagRequired("ts-auth-key")
+	cmd.Flags().StringVar(&req.Password, "password", "",
+		"Password for the hc user of the node. Only its SHA-512 crypt hash is stored in the node OS config")
+	cmd.Flags().BoolVar(&passwordPrompt, "password-prompt", false,
+		"Prompt for the password for the hc user of the node instead of passing it with --password")
+	if info.Wifi {
+		cmd.Flags().StringArrayVar(&wifi, "wifi", nil,
+			"Colon separated Wi-Fi network name and password to connect the node to (e.g. \"my-wifi:password\"). "+
+				"The password is prompted for if omitted, use \"my-wifi:\" for an open network. "+
+				"Can be specified multiple times, the networks specified first are preferred")
+	}
+	for _, opt := range info.Options {
+		options[opt.Name] = cmd.Flags().String(opt.Name, "", opt.Usage)
+		if opt.Required {
+			_ = cmd.MarkFlagRequired(opt.Name)
+		}
+	}
+	return cmd
+}
+
+// readPassword returns the password passed with --password flag or prompts for it if --password-prompt flag is set.
+func readPassword(password string, passwordPrompt bool) (string, error) {
+	if !passwordPrompt {
+		return password, nil
+	}
+	if password != "" {
+		return "", fmt.Errorf("--password and --password-prompt flags cannot be used together")
+	}
+	return prompt.NewPassword("Password for the hc user: ")
+}
@@ -0,0 +1,27 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewDeleteCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete NAME [-c CLUSTER_NAME]",
+		Short: "Deprovision a node and delete it from a Kubernetes cluster",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			if err := c.DeleteNode(clusterName, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Node %s has been deleted.\n", args[0])
+			return nil
+		},
+	}
+	return cmd
+}
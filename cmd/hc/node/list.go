@@ -0,0 +1,38 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+)
+
+func NewListCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list [-c CLUSTER_NAME]",
+		Aliases: []string{"ls"},
+		Short:   "List nodes in a Kubernetes cluster",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			if _, err := c.GetCluster(clusterName); err != nil {
+				return err
+			}
+			nodes, err := c.ListNodes(clusterName)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			_, _ = fmt.Fprintln(w, "NAME\tPROVIDER\tROLE\tHOST")
+			for _, n := range nodes {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n.Name, n.Provider, n.Role(), n.Host())
+			}
+			return w.Flush()
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewPushKeyCommand(c *client.Client) *cobra.Command {
+	req := client.PushKeyRequest{}
+	cmd := &cobra.Command{
+		Use:   "push-key NAME [--host [USER@]HOST[:PORT]] [--rotate] [-c CLUSTER_NAME]",
+		Short: "Install the key that unseals the secrets in the OS config on a running node",
+		Long: "Connect to a running node over SSH and install the node key that unseals the secrets (passwords, " +
+			"Tailscale auth key, k3s token) in its OS config. The key is never written to the node disk along " +
+			"with the config so it must be installed separately. Until then, the node only applies the SSH keys, " +
+			"hostname and wired network settings so use --host with its address in the local network. Nodes that " +
+			"connect to the network over Wi-Fi only can't be reached before the key is installed, write the key " +
+			"to a removable medium with `hc node write-key` for them instead.\n\n" +
+			"Use --rotate to generate a new key and install it along with the OS config re-sealed to it. Secrets " +
+			"sealed to the old key in drop-in configs must be re-sealed separately.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			node, err := c.PushNodeKey(req)
+			if err != nil {
+				return err
+			}
+			if req.Rotate {
+				fmt.Printf("Node key of node %s has been rotated. The re-sealed OS config is applied on the next "+
+					"boot.\n", node.Name)
+			} else {
+				fmt.Printf("Node key has been installed on node %s.\n", node.Name)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&req.Host, "host", "",
+		"Host to connect to over SSH in the [user@]host[:port] format (default user is hc, default host is the "+
+			"node hostname)")
+	cmd.Flags().StringVar(&req.SSHKey, "ssh-key", "",
+		"Path to the SSH private key to connect to the host with (default is the cluster SSH key)")
+	cmd.Flags().BoolVar(&req.Rotate, "rotate", false,
+		"Generate a new node key and re-seal the secrets in the OS config to it")
+	return cmd
+}
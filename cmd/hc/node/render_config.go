@@ -0,0 +1,121 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/cmd/hc/prompt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+)
+
+func NewRenderConfigCommand(c *client.Client) *cobra.Command {
+	req := client.NodeRequest{}
+	var (
+		provider       string
+		wifi           []string
+		passwordPrompt bool
+		save           bool
+	)
+	options := map[string]*string{}
+	cmd := &cobra.Command{
+		Use:   "render-config NAME [-c CLUSTER_NAME]",
+		Short: "Print the OS config for a new node without provisioning it",
+		Long: "Generate the OS config (hcos.yaml) for a new node the same way as the create command does and print " +
+			"it as YAML. This is useful to review the config or to install the node manually, e.g. using " +
+			"a third-party image writer. Use --save to add the node to the cluster so that the cluster roles of " +
+			"the following nodes are consistent with the printed config.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			p, err := client.GetProvider(provider)
+			if err != nil {
+				return err
+			}
+			supported := map[string]bool{}
+			for _, opt := range p.Describe().Options {
+				supported[opt.Name] = true
+			}
+			req.Options = map[string]string{}
+			for name, value := range options {
+				if !cmd.Flags().Changed(name) {
+					continue
+				}
+				if !supported[name] {
+					return fmt.Errorf("--%s flag is not supported by %s provider", name, provider)
+				}
+				req.Options[name] = *value
+			}
+			if req.Password, err = readPassword(req.Password, passwordPrompt); err != nil {
+				return err
+			}
+			if wifi, err = prompt.WifiPasswords(wifi); err != nil {
+				return err
+			}
+			req.Wifi = client.ParseWifiNetworks(wifi)
+			node, err := c.RenderNode(provider, req, save)
+			if err != nil {
+				return err
+			}
+			data, err := node.OSConfig.Marshal()
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			if save {
+				fmt.Fprintf(os.Stderr, "Node %s has been saved to cluster %s.\n", node.Name, node.ClusterName)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&provider, "provider", client.RPi4Provider, "Provider of the node")
+	cmd.Flags().BoolVar(&req.ControlPlane, "control-plane", false,
+		"Create a control plane node for the cluster (default is create a worker node)")
+	cmd.Flags().StringVar(&req.TailscaleAuthKey, "ts-auth-key", "",
+		"Tailscale auth key for registering the node in a tailnet")
+	_ = cmd.MarkFlagRequired("ts-auth-key")
+	cmd.Flags().StringVar(&req.Password, "password", "",
+		"Password for the hc user of the node. Only its SHA-512 crypt hash is stored in the node OS config")
+	cmd.Flags().BoolVar(&passwordPrompt, "password-prompt", false,
+		"Prompt for the password for the hc user of the node instead of passing it with --password")
+	cmd.Flags().StringArrayVar(&wifi, "wifi", nil,
+		"Colon separated Wi-Fi network name and password to connect the node to (e.g. \"my-wifi:password\"). "+
+			"The password is prompted for if omitted, use \"my-wifi:\" for an open network. "+
+			"Can be specified multiple times, the networks specified first are preferred")
+	cmd.Flags().BoolVar(&save, "save", false,
+		"Save the node to the cluster to reserve its name and cluster role")
+
+	// Provider specific options are exposed as flags with the same names as for the create commands. Options with
+	// the same name are shared by the providers that support them.
+	usages := map[string]string{}
+	providers := map[string][]string{}
+	for _, p := range client.Providers() {
+		info := p.Describe()
+		for _, opt := range info.Options {
+			if _, ok := usages[opt.Name]; !ok {
+				usages[opt.Name] = opt.Usage
+			}
+			providers[opt.Name] = append(providers[opt.Name], info.Name)
+		}
+	}
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		usage := fmt.Sprintf("%s (%s provider only)", usages[name], providers[name][0])
+		if len(providers[name]) > 1 {
+			// The usages of a shared option are provider specific, e.g. the image formats, so they're not repeated.
+			usage = fmt.Sprintf("The %s option of %s providers, see their create commands for details",
+				name, strings.Join(providers[name], ", "))
+		}
+		options[name] = cmd.Flags().String(name, "", usage)
+	}
+	return cmd
+}
@@ -2,20 +2,48 @@ package node
 
 import (
 	"github.com/psviderski/homecloud/cmd/hc/node/rpi4"
+	"github.com/psviderski/homecloud/cmd/hc/node/vm"
 	"github.com/psviderski/homecloud/internal/client"
 	"github.com/spf13/cobra"
 )
 
+// providerCommands returns provider specific commands in addition to the generic ones generated for every provider.
+var providerCommands = map[string]func(c *client.Client) []*cobra.Command{
+	client.RPi4Provider: rpi4.NewCommands,
+	client.VMProvider:   vm.NewCommands,
+}
+
 func NewNodeCommand(c *client.Client) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "node",
 		Short: "Manage nodes for a Kubernetes cluster",
 		// TODO: use PersistentPreRunE to set --cluster flag to the default cluster.
 	}
+	for _, p := range client.Providers() {
+		cmd.AddCommand(NewProviderCommand(c, p))
+	}
 	cmd.AddCommand(
-		rpi4.NewRPi4Command(c),
+		NewAdoptCommand(c),
+		NewPushKeyCommand(c),
+		NewWriteKeyCommand(c),
+		NewListCommand(c),
+		NewRenderConfigCommand(c),
+		NewDeleteCommand(c),
 	)
 	cmd.PersistentFlags().StringP("cluster", "c", "", "Kubernetes cluster name")
 	_ = cmd.MarkPersistentFlagRequired("cluster")
 	return cmd
 }
+
+func NewProviderCommand(c *client.Client, p client.Provider) *cobra.Command {
+	info := p.Describe()
+	cmd := &cobra.Command{
+		Use:   info.Name,
+		Short: "Manage " + info.Title + " nodes for a Kubernetes cluster",
+	}
+	cmd.AddCommand(NewCreateCommand(c, p))
+	if newCommands, ok := providerCommands[info.Name]; ok {
+		cmd.AddCommand(newCommands(c)...)
+	}
+	return cmd
+}
@@ -0,0 +1,185 @@
+package rpi4
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/cmd/hc/prompt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type createManyOptions struct {
+	nodes            []string
+	file             string
+	tailscaleAuthKey string
+	image            string
+	wifi             []string
+	password         string
+	passwordPrompt   bool
+}
+
+// nodesFile is a YAML file that lists the nodes to create, for example:
+//
+//	nodes:
+//	  - name: pi1
+//	    role: control-plane
+//	    disk: /dev/disk4
+//	  - name: pi2
+//	    role: worker
+//	    disk: /dev/disk5
+type nodesFile struct {
+	Nodes []nodeSpec `yaml:"nodes"`
+}
+
+type nodeSpec struct {
+	Name string `yaml:"name"`
+	Role string `yaml:"role"`
+	Disk string `yaml:"disk"`
+}
+
+const (
+	controlPlaneSpecRole = "control-plane"
+	workerSpecRole       = "worker"
+)
+
+func NewCreateManyCommand(c *client.Client) *cobra.Command {
+	opts := createManyOptions{}
+	cmd := &cobra.Command{
+		Use:   "create-many [-c CLUSTER_NAME] (--node NAME:ROLE:DISK... | --file FILE)",
+		Short: "Create multiple Raspberry Pi 4 nodes for a Kubernetes cluster writing their disks in parallel",
+		Long: "Create multiple Raspberry Pi 4 nodes for a Kubernetes cluster at once. The image is decompressed only " +
+			"once and written to all the disks concurrently. Nodes are assigned cluster roles in the order they are " +
+			"specified so if the cluster has no nodes yet, the first one must be a control plane node.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			return createMany(c, clusterName, opts)
+		},
+	}
+	cmd.Flags().StringArrayVar(&opts.nodes, "node", nil,
+		"Colon separated node name, role (control-plane or worker), and disk device to install the node OS on "+
+			"(e.g. \"pi1:control-plane:/dev/disk4\"). Can be specified multiple times")
+	cmd.Flags().StringVarP(&opts.file, "file", "f", "",
+		"YAML file with a list of nodes to create, each with name, role (control-plane or worker), and disk")
+	cmd.Flags().StringVar(&opts.tailscaleAuthKey, "ts-auth-key", "",
+		"Tailscale auth key for registering the nodes in a tailnet")
+	_ = cmd.MarkFlagRequired("ts-auth-key")
+	cmd.Flags().StringVar(&opts.image, "image", "",
+		"Path to the Home Cloud OS image to use for the nodes")
+	_ = cmd.MarkFlagRequired("image")
+	cmd.Flags().StringArrayVar(&opts.wifi, "wifi", nil,
+		"Colon separated Wi-Fi network name and password to connect the nodes to (e.g. \"my-wifi:password\"). "+
+			"The password is prompted for if omitted, use \"my-wifi:\" for an open network. "+
+			"Can be specified multiple times, the networks specified first are preferred")
+	cmd.Flags().StringVar(&opts.password, "password", "",
+		"Password for the hc user of the nodes. Only its SHA-512 crypt hash is stored in the node OS configs")
+	cmd.Flags().BoolVar(&opts.passwordPrompt, "password-prompt", false,
+		"Prompt for the password for the hc user of the nodes instead of passing it with --password")
+	return cmd
+}
+
+func createMany(c *client.Client, clusterName string, opts createManyOptions) error {
+	specs, err := parseNodeSpecs(opts)
+	if err != nil {
+		return err
+	}
+	if opts.passwordPrompt {
+		if opts.password != "" {
+			return fmt.Errorf("--password and --password-prompt flags cannot be used together")
+		}
+		if opts.password, err = prompt.NewPassword("Password for the hc user: "); err != nil {
+			return err
+		}
+	}
+	if opts.wifi, err = prompt.WifiPasswords(opts.wifi); err != nil {
+		return err
+	}
+	wifi := client.ParseWifiNetworks(opts.wifi)
+	reqs := make([]client.NodeRequest, len(specs))
+	for i, s := range specs {
+		reqs[i] = client.NodeRequest{
+			Name:             s.Name,
+			ClusterName:      clusterName,
+			ControlPlane:     s.Role == controlPlaneSpecRole,
+			Wifi:             wifi,
+			TailscaleAuthKey: opts.tailscaleAuthKey,
+			Password:         opts.password,
+			Options: map[string]string{
+				client.ImageOption: opts.image,
+				client.DiskOption:  s.Disk,
+			},
+		}
+	}
+	results, err := c.CreateRPi4Nodes(reqs)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tROLE\tDISK\tSTATUS")
+	failed := 0
+	for _, r := range results {
+		status := "created"
+		if r.Err != nil {
+			status = "failed: " + r.Err.Error()
+			failed++
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Node.Name, r.Node.Role(), r.Device, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes failed to be created", failed, len(results))
+	}
+	fmt.Println("The secrets in the node OS configs are sealed to the node keys. Write the key of each node to " +
+		"a removable medium to attach to it for the first boot (required if the node connects over Wi-Fi only):\n" +
+		"  hc node write-key NAME -c CLUSTER_NAME --disk DEVICE [--format]\n" +
+		"or push it over SSH after the first boot if the node has a wired connection:\n" +
+		"  hc node push-key NAME -c CLUSTER_NAME --host ADDRESS")
+	return nil
+}
+
+func parseNodeSpecs(opts createManyOptions) ([]nodeSpec, error) {
+	if (len(opts.nodes) == 0) == (opts.file == "") {
+		return nil, fmt.Errorf("either --node or --file flag must be specified")
+	}
+	var specs []nodeSpec
+	if opts.file != "" {
+		data, err := os.ReadFile(opts.file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read nodes file %q: %w", opts.file, err)
+		}
+		var f nodesFile
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("unable to parse nodes file %q: %w", opts.file, err)
+		}
+		specs = f.Nodes
+	}
+	for _, n := range opts.nodes {
+		parts := strings.SplitN(n, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid node %q, must be in the format NAME:ROLE:DISK", n)
+		}
+		specs = append(specs, nodeSpec{Name: parts[0], Role: parts[1], Disk: parts[2]})
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no nodes to create")
+	}
+	for _, s := range specs {
+		if s.Name == "" || s.Disk == "" {
+			return nil, fmt.Errorf("node name and disk are required for every node")
+		}
+		if s.Role != controlPlaneSpecRole && s.Role != workerSpecRole {
+			return nil, fmt.Errorf("invalid role %q for node %q, must be one of: %s, %s",
+				s.Role, s.Name, controlPlaneSpecRole, workerSpecRole)
+		}
+	}
+	return specs, nil
+}
@@ -0,0 +1,52 @@
+package rpi4
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/cmd/hc/prompt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewReconfigureCommand(c *client.Client) *cobra.Command {
+	req := client.ReconfigureRequest{}
+	var wifi []string
+	cmd := &cobra.Command{
+		Use:   "reconfigure NAME --disk DEVICE [-c CLUSTER_NAME]",
+		Short: "Update the OS config on a disk with an installed Raspberry Pi 4 node image without reinstalling it",
+		Long: "Regenerate the OS config of an existing Raspberry Pi 4 node and write it to the boot partition of the " +
+			"disk (e.g. SD card) with an already installed Home Cloud OS image. The config is applied on the next " +
+			"boot even if the node has already booted before.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			if len(wifi) > 0 && req.RemoveWifi {
+				return fmt.Errorf("--wifi and --no-wifi flags cannot be used together")
+			}
+			if wifi, err = prompt.WifiPasswords(wifi); err != nil {
+				return err
+			}
+			req.Wifi = client.ParseWifiNetworks(wifi)
+			node, err := c.ReconfigureRPi4Node(req)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("OS config for Raspberry Pi 4 node %s has been written to %s.\n", node.Name, req.InstallDevice)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&req.TailscaleAuthKey, "ts-auth-key", "",
+		"New Tailscale auth key for registering the node in a tailnet (default is keep the current one)")
+	cmd.Flags().StringArrayVar(&wifi, "wifi", nil,
+		"Colon separated Wi-Fi network name and password to connect the node to (e.g. \"my-wifi:password\"). "+
+			"The password is prompted for if omitted, use \"my-wifi:\" for an open network. "+
+			"Can be specified multiple times, the networks specified first are preferred")
+	cmd.Flags().BoolVar(&req.RemoveWifi, "no-wifi", false, "Remove the Wi-Fi network configuration")
+	cmd.Flags().StringVar(&req.InstallDevice, "disk", "",
+		"Disk device with an installed Home Cloud OS image to update the config on (e.g. /dev/disk4)")
+	_ = cmd.MarkFlagRequired("disk")
+	return cmd
+}
@@ -0,0 +1,14 @@
+package rpi4
+
+import (
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+// NewCommands returns Raspberry Pi 4 specific commands in addition to the generic provider commands.
+func NewCommands(c *client.Client) []*cobra.Command {
+	return []*cobra.Command{
+		NewCreateManyCommand(c),
+		NewReconfigureCommand(c),
+	}
+}
@@ -0,0 +1,143 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// consoleEscape is the Ctrl+] key that detaches from the VM console.
+const consoleEscape = 0x1d
+
+// NewCommands returns VM specific commands in addition to the generic provider commands.
+func NewCommands(c *client.Client) []*cobra.Command {
+	return []*cobra.Command{
+		NewStartCommand(c),
+		NewStopCommand(c),
+		NewConsoleCommand(c),
+	}
+}
+
+func NewStartCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "start NAME [-c CLUSTER_NAME]",
+		Short: "Start a VM node in the background",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			if err := c.StartVM(clusterName, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("VM node %s has been started. Use `hc node vm console %s` to attach to its console.\n",
+				args[0], args[0])
+			return nil
+		},
+	}
+	return cmd
+}
+
+func NewStopCommand(c *client.Client) *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "stop NAME [-c CLUSTER_NAME]",
+		Short: "Shut down a running VM node",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			if err := c.StopVM(clusterName, args[0], force); err != nil {
+				return err
+			}
+			fmt.Printf("VM node %s has been stopped.\n", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&force, "force", "f", false,
+		"Kill the VM immediately instead of shutting it down gracefully")
+	return cmd
+}
+
+func NewConsoleCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "console NAME [-c CLUSTER_NAME]",
+		Short: "Attach to the serial console of a running VM node",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clusterName, err := cmd.Flags().GetString("cluster")
+			if err != nil {
+				return err
+			}
+			socket, err := c.VMConsoleSocket(clusterName, args[0])
+			if err != nil {
+				return err
+			}
+			return attachConsole(socket)
+		},
+	}
+	return cmd
+}
+
+// attachConsole connects the terminal to the VM console socket until the escape key is pressed or the VM exits.
+func attachConsole(socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM console: %w", err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	// Pass all key presses to the VM as is.
+	if err := stty("raw", "-echo"); err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer stty("sane")
+	fmt.Print("Connected to VM console. Press Ctrl+] to detach.\r\n")
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			for i := 0; i < n; i++ {
+				if buf[i] == consoleEscape {
+					if _, err := conn.Write(buf[:i]); err != nil {
+						done <- err
+						return
+					}
+					done <- nil
+					return
+				}
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	err = <-done
+	fmt.Print("\r\nDetached from VM console.\r\n")
+	return err
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,46 @@
+package node
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func NewWriteKeyCommand(c *client.Client) *cobra.Command {
+	req := client.WriteKeyRequest{}
+	cmd := &cobra.Command{
+		Use:   "write-key NAME --disk DEVICE [--format] [-c CLUSTER_NAME]",
+		Short: "Write the key that unseals the secrets in the OS config to a removable medium for a node",
+		Long: "Write the node key that unseals the secrets (passwords, Wi-Fi passwords, Tailscale auth key, k3s " +
+			"token) in the OS config of a node to a removable medium, e.g. a USB flash drive. The first partition " +
+			"of the medium must be a FAT partition labelled HCOS_KEY, use --format to erase the medium and create " +
+			"it. Attach the medium to the node for the first boot or while the node is waiting for the key, the " +
+			"node moves the key from the medium to its disk.\n\n" +
+			"This is the only way to install the key on nodes that connect to the network over Wi-Fi only as " +
+			"they can't connect to Wi-Fi before the secrets are unsealed. Nodes with a wired connection can get " +
+			"the key over SSH with `hc node push-key` instead. VM nodes get the key on a key drive attached " +
+			"automatically.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Name = args[0]
+			var err error
+			if req.ClusterName, err = cmd.Flags().GetString("cluster"); err != nil {
+				return err
+			}
+			node, err := c.WriteNodeKey(req)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Node key of node %s has been written to %s. Attach it to the node for the first boot.\n",
+				node.Name, req.Device)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&req.Device, "disk", "",
+		"Disk device of the removable medium (e.g. /dev/disk4) to write the node key to")
+	_ = cmd.MarkFlagRequired("disk")
+	cmd.Flags().BoolVar(&req.Format, "format", false,
+		"Erase the medium and create a FAT32 partition labelled HCOS_KEY on it. Please use with caution as all "+
+			"data on the medium will be destroyed!")
+	return cmd
+}
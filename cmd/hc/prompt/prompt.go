@@ -0,0 +1,74 @@
+// Package prompt reads secrets such as passwords from the terminal without echoing them.
+package prompt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// stdin is shared by all prompts so that the input buffered by one prompt isn't lost for the following ones when
+// the input is piped.
+var stdin = bufio.NewReader(os.Stdin)
+
+// Secret prints the message to stderr and reads a line from stdin with the terminal echo disabled.
+func Secret(message string) (string, error) {
+	fmt.Fprint(os.Stderr, message)
+	// Disabling the echo fails if stdin is not a terminal in which case the input is read as is.
+	if stty("-echo") == nil {
+		//goland:noinspection GoUnhandledErrorResult
+		defer stty("echo")
+		defer fmt.Fprintln(os.Stderr)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("failed to read input: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// NewPassword prompts for a new non-empty password twice to make sure it's typed correctly.
+func NewPassword(message string) (string, error) {
+	password, err := Secret(message)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	confirm, err := Secret("Confirm password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return password, nil
+}
+
+// WifiPasswords prompts for the passwords of the colon separated Wi-Fi network names and passwords that omit them,
+// e.g. "my-wifi", and returns the values with the passwords added.
+func WifiPasswords(values []string) ([]string, error) {
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i] = v
+		if strings.Contains(v, ":") {
+			continue
+		}
+		password, err := Secret(fmt.Sprintf("Password for Wi-Fi network %s (leave empty for an open network): ", v))
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v + ":" + password
+	}
+	return result, nil
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,18 @@
+package config
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage Home Cloud OS config",
+	}
+	cmd.AddCommand(
+		NewSchemaCommand(),
+		NewShowCommand(),
+		NewValidateCommand(),
+	)
+	return cmd
+}
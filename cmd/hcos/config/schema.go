@@ -0,0 +1,23 @@
+package config
+
+import (
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func NewSchemaCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the config file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := config.Schema()
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(schema)
+			return err
+		},
+	}
+}
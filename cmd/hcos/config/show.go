@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v3"
+	"os"
+)
+
+type showOptions struct {
+	merged bool
+}
+
+func NewShowCommand() *cobra.Command {
+	opts := showOptions{}
+	cmd := &cobra.Command{
+		Use:   "show [FILE]",
+		Short: "Print the config",
+		Long: fmt.Sprintf("Print the config file upgraded to the current version. With --merged, print the effective "+
+			"config with the drop-in configs from the %s directory merged onto it and the file each value comes "+
+			"from in a comment. The default config %s is printed if FILE is not specified.",
+			config.DropInDirName, config.DefaultConfigPath),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := config.DefaultConfigPath
+			if len(args) > 0 {
+				path = args[0]
+			}
+			return runShow(path, opts)
+		},
+	}
+	cmd.Flags().BoolVar(&opts.merged, "merged", false, "Print the effective config with the drop-in configs merged")
+	return cmd
+}
+
+func runShow(path string, opts showOptions) error {
+	if opts.merged {
+		doc, err := config.MergeDropIns(path, false, true)
+		if err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file %q: %w", path, err)
+	}
+	cfg, err := config.ParseConfig(data, false)
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %q: %w", path, err)
+	}
+	data, err = cfg.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type validateOptions struct {
+	strict bool
+}
+
+func NewValidateCommand() *cobra.Command {
+	opts := validateOptions{}
+	cmd := &cobra.Command{
+		Use:   "validate [FILE]",
+		Short: "Validate a config file",
+		Long: fmt.Sprintf("Validate a config file and report all invalid fields. "+
+			"The default config %s is validated if FILE is not specified.", config.DefaultConfigPath),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := config.DefaultConfigPath
+			if len(args) > 0 {
+				path = args[0]
+			}
+			return runValidate(path, opts)
+		},
+	}
+	cmd.Flags().BoolVar(&opts.strict, "strict", true, "Reject unknown fields")
+	return cmd
+}
+
+func runValidate(path string, opts validateOptions) error {
+	var (
+		cfg config.Config
+		err error
+	)
+	if opts.strict {
+		cfg, err = config.ReadConfigStrict(path)
+	} else {
+		cfg, err = config.ReadConfig(path)
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if err := cfg.Validate(); err != nil {
+		var vErr *config.ValidationError
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		for _, fErr := range vErr.Errors {
+			fmt.Fprintln(os.Stderr, fErr)
+		}
+		return fmt.Errorf("config file %q is invalid", path)
+	}
+	fmt.Printf("Config file %q is valid.\n", path)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/psviderski/homecloud/cmd/hcos/agent"
+	"github.com/psviderski/homecloud/cmd/hcos/config"
 	"github.com/spf13/cobra"
 )
 
@@ -14,6 +15,7 @@ func main() {
 	}
 	app.AddCommand(
 		agent.NewCommand(),
+		config.NewCommand(),
 	)
 	cobra.CheckErr(app.Execute())
 }
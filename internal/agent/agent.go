@@ -1,39 +1,43 @@
 package agent
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
+	"github.com/psviderski/homecloud/internal/k3s"
 	"github.com/psviderski/homecloud/internal/system"
 	"github.com/psviderski/homecloud/internal/tailscale"
 	"github.com/psviderski/homecloud/pkg/os/config"
 	"gopkg.in/yaml.v3"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
 	connManConfigDir  = "/etc/connman"
 	connManServiceDir = "/var/lib/connman"
-	k3sEnvFilePath    = "/etc/rancher/k3s/k3s.env"
-	k3sConfigPath     = "/etc/rancher/k3s/config.yaml"
 
-	loginUsername = "hc"
-)
+	// tailscaleServiceConf is sourced by the tailscale OpenRC service script.
+	tailscaleServiceConf = "/etc/conf.d/tailscale"
+	managedBlockBegin    = "# BEGIN hcos managed block"
+	managedBlockEnd      = "# END hcos managed block"
 
-// K3sConfig stores configuration parameters for K3s server or agent. It is intended to be serialized as YAML to a file
-// that is used by K3s to load configuration from (default: /etc/rancher/k3s/config.yaml). See for more details about
-// K3s configuration file: https://rancher.com/docs/k3s/latest/en/installation/install-options/#configuration-file
-type K3sConfig struct {
-	ClusterInit  bool   `yaml:"cluster-init,omitempty"`
-	Server       string `yaml:"server,omitempty"`
-	Token        string `yaml:"token"`
-	BindAddress  string `yaml:"bind-address,omitempty"`
-	FlannelIface string `yaml:"flannel-iface"`
-}
+	loginUsername = config.LoginUsername
+
+	nodeKeyPollInterval = 5 * time.Second
+	// nodeKeyMediumLabel is a label of the removable medium with the node key written by "hc node write-key".
+	// Keep the label in sync with the one defined in /overlay/common/system/oem/03_setup_config.yaml.
+	nodeKeyMediumLabel = "HCOS_KEY"
+)
 
-func ApplyConfig(cfg config.Config, root string) error {
-	if err := applyPassword(cfg.Password); err != nil {
+// ApplyConfig applies the config to the system. Secret references in the config are resolved with the secrets
+// resolver just before the secrets are used.
+func ApplyConfig(cfg config.Config, root string, secrets *config.SecretResolver) error {
+	if err := applyPassword(cfg.Password, secrets); err != nil {
 		return err
 	}
 	if err := applySSHAuthorizedKeys(cfg.SSHAuthorizedKeys); err != nil {
@@ -42,16 +46,32 @@ func ApplyConfig(cfg config.Config, root string) error {
 	if err := applyHostname(cfg.Hostname); err != nil {
 		return err
 	}
-	if err := applyNetwork(cfg.Network, root); err != nil {
+	if err := applyNetwork(cfg.Network, root, secrets); err != nil {
+		return err
+	}
+	// System settings and additional users are applied after the network so that a mistake in them, e.g. a kernel
+	// module or group that doesn't exist, doesn't make the node unreachable to fix the config.
+	if err := applySystem(cfg.System, root); err != nil {
+		return err
+	}
+	if err := applyUsers(cfg.Users, root, secrets); err != nil {
 		return err
 	}
-	if err := applyK3s(cfg.K3s); err != nil {
+	if err := applyK3s(cfg.K3s, cfg.Network.Proxy, secrets); err != nil {
 		return err
 	}
+	if err := applyWriteFiles(cfg.WriteFiles, root); err != nil {
+		return err
+	}
+	runCommands(cfg.RunCommands, config.BeforeK3sStage)
 	return nil
 }
 
-func applyPassword(password string) error {
+func applyPassword(password string, secrets *config.SecretResolver) error {
+	password, err := secrets.Resolve(password)
+	if err != nil {
+		return fmt.Errorf("unable to resolve password: %w", err)
+	}
 	password = strings.TrimSpace(password)
 	if password != "" {
 		return system.SetPassword(loginUsername, password)
@@ -65,46 +85,217 @@ func applySSHAuthorizedKeys(keys []string) error {
 }
 
 func applyHostname(hostname string) error {
-	// TODO: validate hostname contains correct chars
 	return system.SetHostname(strings.TrimSpace(hostname))
 }
 
-func applyNetwork(cfg config.NetworkConfig, root string) error {
+func applyNetwork(cfg config.NetworkConfig, root string, secrets *config.SecretResolver) error {
 	if err := os.MkdirAll(path.Join(root, connManConfigDir), 0755); err != nil {
 		return fmt.Errorf("failed to create directory %q: %v", connManConfigDir, err)
 	}
 	mainPath := path.Join(root, connManConfigDir, "main.conf")
-	mainContent := `[General]
-NetworkInterfaceBlacklist=veth
-PreferredTechnologies=ethernet,wifi
-FallbackNameservers=1.1.1.1
-FallbackTimeservers=pool.ntp.org
+	mainContent := fmt.Sprintf(`[General]
+NetworkInterfaceBlacklist=%s
+PreferredTechnologies=%s
+FallbackNameservers=%s
+FallbackTimeservers=%s
 AllowHostnameUpdates=false
-`
-	if err := os.WriteFile(mainPath, []byte(mainContent), 0644); err != nil {
-		return fmt.Errorf("unable to write ConnMan config %q: %w", mainPath, err)
+`, strings.Join(cfg.InterfaceBlacklistOrDefault(), ","), strings.Join(cfg.PreferredTechnologiesOrDefault(), ","),
+		strings.Join(cfg.DNSOrDefault(), ","), strings.Join(cfg.NTPOrDefault(), ","))
+	// Restart ConnMan only when its config changes as restarting it interrupts the network connections.
+	current, err := os.ReadFile(mainPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read ConnMan config %q: %w", mainPath, err)
+	}
+	if string(current) != mainContent {
+		if err := os.WriteFile(mainPath, []byte(mainContent), 0644); err != nil {
+			return fmt.Errorf("unable to write ConnMan config %q: %w", mainPath, err)
+		}
+		if err := system.RestartService("connman"); err != nil {
+			return err
+		}
+		fmt.Println("ConnMan config has been updated.")
 	}
 
-	if err := applyWifi(cfg.Wifi, root); err != nil {
+	// Failing to configure a wired interface doesn't prevent configuring Wi-Fi and Tailscale which may be the only
+	// way to reach the node.
+	ifacesErr := applyInterfaces(cfg.Interfaces, root)
+	if err := applyWifi(cfg.Wifi, root, secrets); err != nil {
 		return err
 	}
-	if err := applyTailscale(cfg.Tailscale); err != nil {
+	if err := applyTailscaleProxy(cfg.Proxy, root); err != nil {
 		return err
 	}
-	return nil
+	if err := applyTailscale(cfg.Tailscale, secrets); err != nil {
+		return err
+	}
+	return ifacesErr
 }
 
-func applyWifi(cfg config.WifiConfig, root string) error {
-	if cfg.Name == "" && cfg.Password == "" {
+// applyInterfaces writes ConnMan provisioning sections for the wired interfaces and sets their MTU. Interfaces
+// specified by name are bound to their MAC addresses as ConnMan identifies provisioned services by MAC address.
+// The sections of the interfaces that can be resolved are written even if some of them can't be.
+func applyInterfaces(ifaces []config.InterfaceConfig, root string) error {
+	servicePath := path.Join(root, connManServiceDir, "cloud-config-interfaces.config")
+	if len(ifaces) == 0 {
+		if err := os.Remove(servicePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove ConnMan config %q: %w", servicePath, err)
+		}
 		return nil
 	}
-	if cfg.Name == "" {
+	links, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("unable to list network interfaces: %w", err)
+	}
+	content, mtus, resolveErr := renderInterfaces(ifaces, links)
+	if content == "" && resolveErr != nil {
+		return resolveErr
+	}
+	if err := os.MkdirAll(path.Join(root, connManServiceDir), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", connManServiceDir, err)
+	}
+	if err := os.WriteFile(servicePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("unable to write ConnMan config %q: %w", servicePath, err)
+	}
+	for _, m := range mtus {
+		if err := system.SetMTU(m.name, m.mtu); err != nil {
+			return err
+		}
+	}
+	return resolveErr
+}
+
+type interfaceMTU struct {
+	name string
+	mtu  int
+}
 
-		return errors.New("wifi network name is required")
+// renderInterfaces renders the ConnMan provisioning sections for the wired interfaces resolved against the links
+// of the system and returns the MTUs to set on them. Interfaces specified by MAC address are rendered from the config
+// alone, they are only looked up to set their MTU. An error listing the interfaces that can't be resolved is returned
+// along with the sections of the others.
+func renderInterfaces(ifaces []config.InterfaceConfig, links []net.Interface) (string, []interfaceMTU, error) {
+	var (
+		content    strings.Builder
+		mtus       []interfaceMTU
+		unresolved []string
+	)
+	for i, iface := range ifaces {
+		name, mac := iface.Name, ""
+		if iface.Name != "" {
+			for _, link := range links {
+				if link.Name == iface.Name {
+					mac = link.HardwareAddr.String()
+				}
+			}
+			if mac == "" {
+				unresolved = append(unresolved, iface.Name)
+				continue
+			}
+		} else {
+			hw, err := net.ParseMAC(iface.MAC)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid MAC address %q: %w", iface.MAC, err)
+			}
+			mac = hw.String()
+			for _, link := range links {
+				if bytes.Equal(link.HardwareAddr, hw) {
+					name = link.Name
+				}
+			}
+			// ConnMan doesn't need the interface to be present but its MTU can only be set on an existing one.
+			if name == "" && iface.MTU != 0 {
+				unresolved = append(unresolved, mac)
+			}
+		}
+		if content.Len() > 0 {
+			content.WriteString("\n")
+		}
+		fmt.Fprintf(&content, "[service_ethernet_%d]\nType=ethernet\nMAC=%s\n", i, mac)
+		ipv4, err := connManIPv4(iface.IPv4)
+		if err != nil {
+			return "", nil, err
+		}
+		ipv6, err := connManIPv6(iface.IPv6)
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(&content, "IPv4=%s\nIPv6=%s\n", ipv4, ipv6)
+		if len(iface.Nameservers) > 0 {
+			fmt.Fprintf(&content, "Nameservers=%s\n", strings.Join(iface.Nameservers, ","))
+		}
+		if len(iface.SearchDomains) > 0 {
+			fmt.Fprintf(&content, "SearchDomains=%s\n", strings.Join(iface.SearchDomains, ","))
+		}
+		// ConnMan doesn't manage MTU so it's set directly on the interface.
+		if iface.MTU != 0 && name != "" {
+			mtus = append(mtus, interfaceMTU{name: name, mtu: iface.MTU})
+		}
 	}
+	if len(unresolved) > 0 {
+		return content.String(), mtus, fmt.Errorf("network interfaces not found: %s", strings.Join(unresolved, ", "))
+	}
+	return content.String(), mtus, nil
+}
+
+// connManIPv4 formats the IPv4 config as ConnMan provisioning IPv4 value: off, dhcp, or address/netmask[/gateway].
+func connManIPv4(cfg config.IPConfig) (string, error) {
+	switch cfg.MethodOrDefault() {
+	case config.IPMethodOff:
+		return "off", nil
+	case config.IPMethodStatic:
+		ip, ipNet, err := net.ParseCIDR(cfg.Address)
+		if err != nil {
+			return "", fmt.Errorf("invalid IPv4 address %q: %w", cfg.Address, err)
+		}
+		value := fmt.Sprintf("%s/%s", ip, net.IP(ipNet.Mask))
+		if cfg.Gateway != "" {
+			value += "/" + cfg.Gateway
+		}
+		return value, nil
+	}
+	return "dhcp", nil
+}
+
+// connManIPv6 formats the IPv6 config as ConnMan provisioning IPv6 value: off, auto, or address/prefixlen[/gateway].
+func connManIPv6(cfg config.IPConfig) (string, error) {
+	switch cfg.MethodOrDefault() {
+	case config.IPMethodOff:
+		return "off", nil
+	case config.IPMethodStatic:
+		ip, ipNet, err := net.ParseCIDR(cfg.Address)
+		if err != nil {
+			return "", fmt.Errorf("invalid IPv6 address %q: %w", cfg.Address, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		value := fmt.Sprintf("%s/%d", ip, ones)
+		if cfg.Gateway != "" {
+			value += "/" + cfg.Gateway
+		}
+		return value, nil
+	}
+	return "auto", nil
+}
+
+func applyWifi(networks []config.WifiConfig, root string, secrets *config.SecretResolver) error {
 	if err := os.MkdirAll(path.Join(root, connManServiceDir), 0755); err != nil {
 		return fmt.Errorf("failed to create directory %q: %v", connManServiceDir, err)
 	}
+	servicePath := path.Join(root, connManServiceDir, "cloud-config.config")
+	// Remove the networks and CA certificates written previously as the networks could have been removed from
+	// the config.
+	caCerts, err := filepath.Glob(path.Join(root, connManServiceDir, "cloud-config-wifi-*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, p := range append(caCerts, servicePath) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove ConnMan config %q: %w", p, err)
+		}
+	}
+	if len(networks) == 0 {
+		return nil
+	}
+
 	settingsPath := path.Join(root, connManServiceDir, "settings")
 	settingsContent := `[WiFi]
 Enable=true
@@ -113,19 +304,146 @@ Tethering=false
 	if err := os.WriteFile(settingsPath, []byte(settingsContent), 0644); err != nil {
 		return fmt.Errorf("unable to write ConnMan config %q: %w", settingsPath, err)
 	}
-	servicePath := path.Join(root, connManServiceDir, "cloud-config.config")
-	serviceContent := fmt.Sprintf(`[service_wifi]
-Type=wifi
-Name=%s
-Passphrase=%s
-`, cfg.Name, cfg.Password)
-	if err := os.WriteFile(servicePath, []byte(serviceContent), 0600); err != nil {
+	// ConnMan doesn't support priorities of provisioned services, see preferWifi.
+	sorted := make([]config.WifiConfig, len(networks))
+	copy(sorted, networks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	var serviceContent strings.Builder
+	for i, n := range sorted {
+		if i > 0 {
+			serviceContent.WriteString("\n")
+		}
+		password, err := secrets.Resolve(n.Password)
+		if err != nil {
+			return fmt.Errorf("unable to resolve password of Wi-Fi network %q: %w", n.Name, err)
+		}
+		fmt.Fprintf(&serviceContent, "[service_wifi_%d]\nType=wifi\nName=%s\n", i, n.Name)
+		if n.Hidden {
+			serviceContent.WriteString("Hidden=true\n")
+		}
+		switch n.SecurityOrDefault() {
+		case config.WifiSecurityPSK:
+			// ConnMan uses a passphrase of 64 hex digits as the pre-shared key as is.
+			fmt.Fprintf(&serviceContent, "Security=psk\nPassphrase=%s\n", password)
+		case config.WifiSecurityNone:
+			serviceContent.WriteString("Security=none\n")
+		case config.WifiSecurityWPAEAP:
+			fmt.Fprintf(&serviceContent, "Security=ieee8021x\nEAP=%s\nIdentity=%s\nPassphrase=%s\nPhase2=%s\n",
+				n.EAP, n.Identity, password, strings.ToUpper(n.Phase2))
+			if n.AnonymousIdentity != "" {
+				fmt.Fprintf(&serviceContent, "AnonymousIdentity=%s\n", n.AnonymousIdentity)
+			}
+			if n.CACert != "" {
+				certFile := fmt.Sprintf("cloud-config-wifi-%d-ca.pem", i)
+				certPath := path.Join(root, connManServiceDir, certFile)
+				if err := os.WriteFile(certPath, []byte(n.CACert), 0644); err != nil {
+					return fmt.Errorf("unable to write CA certificate %q: %w", certPath, err)
+				}
+				fmt.Fprintf(&serviceContent, "CACertFile=%s\n", path.Join(connManServiceDir, certFile))
+			}
+		}
+	}
+	if err := os.WriteFile(servicePath, []byte(serviceContent.String()), 0600); err != nil {
 		return fmt.Errorf("unable to write ConnMan config %q: %w", servicePath, err)
 	}
+	preferWifi(sorted)
 	return nil
 }
 
-func applyTailscale(cfg config.TailscaleConfig) error {
+// preferWifi connects to the network with the highest priority in range if ConnMan has connected to a network with
+// a lower priority. ConnMan autoconnects to any provisioned network so the preference is only applied when the config
+// is applied, e.g. on boot. Failures are only logged as the node can still be connected to another network.
+func preferWifi(networks []config.WifiConfig) {
+	if len(networks) < 2 || networks[0].Priority == networks[len(networks)-1].Priority {
+		return
+	}
+	services, err := system.ScanWifiServices()
+	if err != nil {
+		fmt.Printf("Unable to apply Wi-Fi network priorities: %v\n", err)
+		return
+	}
+	byName := make(map[string]system.WifiService, len(services))
+	connected := -1
+	for _, svc := range services {
+		byName[svc.Name] = svc
+	}
+	for i, n := range networks {
+		if svc, ok := byName[n.Name]; ok && svc.Connected && connected == -1 {
+			connected = i
+		}
+	}
+	// The networks are sorted by priority so the first one in range is preferred.
+	for _, n := range networks {
+		svc, ok := byName[n.Name]
+		if !ok {
+			continue
+		}
+		if connected != -1 && n.Priority <= networks[connected].Priority {
+			return
+		}
+		fmt.Printf("Connecting to Wi-Fi network %s with the highest priority in range...\n", n.Name)
+		if err := system.ConnectService(svc.ID); err != nil {
+			fmt.Printf("Unable to connect to Wi-Fi network %s: %v\n", n.Name, err)
+			continue
+		}
+		return
+	}
+}
+
+// applyTailscaleProxy exports the proxy environment variables in a managed block of the tailscale service config
+// and restarts tailscaled if the block has changed so that it can log in behind the proxy.
+func applyTailscaleProxy(cfg config.ProxyConfig, root string) error {
+	confPath := path.Join(root, tailscaleServiceConf)
+	current, err := os.ReadFile(confPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read tailscale service config %q: %w", confPath, err)
+	}
+	var block strings.Builder
+	if env := k3s.ProxyEnv(cfg); len(env) > 0 {
+		block.WriteString(managedBlockBegin + "\n")
+		for _, v := range env {
+			name, value, _ := strings.Cut(v, "=")
+			fmt.Fprintf(&block, "export %s=%q\n", name, value)
+		}
+		block.WriteString(managedBlockEnd + "\n")
+	}
+	content := replaceManagedBlock(string(current), block.String())
+	if content == string(current) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(confPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", path.Dir(confPath), err)
+	}
+	if err := os.WriteFile(confPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("unable to write tailscale service config %q: %w", confPath, err)
+	}
+	if err := system.RestartService("tailscale"); err != nil {
+		return err
+	}
+	fmt.Println("Tailscale proxy settings have been updated.")
+	return nil
+}
+
+// replaceManagedBlock replaces the block between managedBlockBegin and managedBlockEnd markers in the content with
+// the new block or appends it if the content doesn't have one. The block is removed if the new block is empty.
+func replaceManagedBlock(content, block string) string {
+	begin := strings.Index(content, managedBlockBegin+"\n")
+	end := strings.Index(content, managedBlockEnd+"\n")
+	if begin >= 0 && end > begin {
+		return content[:begin] + block + content[end+len(managedBlockEnd)+1:]
+	}
+	if block == "" {
+		return content
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + block
+}
+
+func applyTailscale(cfg config.TailscaleConfig, secrets *config.SecretResolver) error {
 	if cfg.AuthKey == "" {
 		return fmt.Errorf("Tailscale auth key is required")
 	}
@@ -141,7 +459,11 @@ func applyTailscale(cfg config.TailscaleConfig) error {
 
 	system.WaitNetwork()
 	fmt.Println("Connecting to Tailscale...")
-	authorized, err := tailscale.Up(cfg.AuthKey)
+	authKey, err := secrets.Resolve(cfg.AuthKey)
+	if err != nil {
+		return fmt.Errorf("unable to resolve Tailscale auth key: %w", err)
+	}
+	authorized, err := tailscale.Up(authKey)
 	if err != nil {
 		return fmt.Errorf("unable to connect to Tailscale: %w", err)
 	}
@@ -159,7 +481,7 @@ func applyTailscale(cfg config.TailscaleConfig) error {
 	return nil
 }
 
-func applyK3s(cfg config.K3sConfig) error {
+func applyK3s(cfg config.K3sConfig, proxy config.ProxyConfig, secrets *config.SecretResolver) error {
 	switch cfg.Role {
 	case config.ClusterInitRole, config.ControlPlaneRole, config.WorkerRole:
 	default:
@@ -175,42 +497,35 @@ func applyK3s(cfg config.K3sConfig) error {
 		return fmt.Errorf("failed while waiting for Tailscale IP: %w", err)
 	}
 
-	k3sCfg := K3sConfig{
-		Token:        cfg.Token,
-		FlannelIface: "tailscale0",
+	// The name is only used for the TLS certificate of the control plane so it's not critical if it can't be retrieved.
+	tsName, err := tailscale.DNSName()
+	if err != nil {
+		fmt.Printf("Unable to get Tailscale DNS name: %v\n", err)
 	}
-	cmd := "server"
-	switch cfg.Role {
-	case config.ClusterInitRole:
-		k3sCfg.ClusterInit = true
-		k3sCfg.BindAddress = tsIP
-	case config.ControlPlaneRole:
-		if cfg.Server == "" {
-			return fmt.Errorf("k3s server to join is required")
-		}
-		k3sCfg.Server = cfg.Server
-		k3sCfg.BindAddress = tsIP
-	case config.WorkerRole:
-		cmd = "agent"
-		if cfg.Server == "" {
-			return fmt.Errorf("k3s server to join is required")
-		}
-		k3sCfg.Server = cfg.Server
-	default:
-		return fmt.Errorf("k3s role is invalid, must be one of: %s, %s, %s",
-			config.ClusterInitRole, config.ControlPlaneRole, config.WorkerRole)
+
+	if cfg.Token, err = secrets.Resolve(cfg.Token); err != nil {
+		return fmt.Errorf("unable to resolve k3s token: %w", err)
+	}
+	k3sCfg, cmd, err := k3s.NewConfig(cfg, tsIP, tsName)
+	if err != nil {
+		return err
 	}
 	k3sCfgYAML, err := yaml.Marshal(&k3sCfg)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(k3sConfigPath, k3sCfgYAML, 0600); err != nil {
-		return fmt.Errorf("failed to write k3s config %s: %w", k3sConfigPath, err)
+	if err := os.WriteFile(k3s.ConfigPath, k3sCfgYAML, 0600); err != nil {
+		return fmt.Errorf("failed to write k3s config %s: %w", k3s.ConfigPath, err)
 	}
-	// Override the default command_args in the /etc/init.d/k3s service script.
+	// Override the default command_args in the /etc/init.d/k3s service script. The service script exports all
+	// the variables from the environment file so the proxy settings are also passed to the embedded containerd.
 	env := fmt.Sprintf("command_args=\"%s\"\n", cmd)
-	if err := os.WriteFile(k3sEnvFilePath, []byte(env), 0600); err != nil {
-		return fmt.Errorf("failed to write k3s environment file %s: %w", k3sEnvFilePath, err)
+	for _, v := range k3s.ProxyEnv(proxy) {
+		name, value, _ := strings.Cut(v, "=")
+		env += fmt.Sprintf("%s=%q\n", name, value)
+	}
+	if err := os.WriteFile(k3s.EnvFilePath, []byte(env), 0600); err != nil {
+		return fmt.Errorf("failed to write k3s environment file %s: %w", k3s.EnvFilePath, err)
 	}
 	return nil
 }
@@ -220,12 +535,58 @@ func StartAgent(cfgPath string) error {
 	if err != nil {
 		return err
 	}
-	if err := ApplyConfig(cfg, "/"); err != nil {
+	// Report all the config problems at once instead of failing on them one by one while applying the config.
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("config file %q: %w", cfgPath, err)
+	}
+	secrets := &config.SecretResolver{
+		Root:        "/",
+		NodeKeyPath: filepath.Join(filepath.Dir(cfgPath), config.NodeKeyFilename),
+	}
+	if cfg.HasSealedSecrets() {
+		waitNodeKey(cfg, secrets.NodeKeyPath)
+	}
+	if err := ApplyConfig(cfg, "/", secrets); err != nil {
 		return fmt.Errorf("unable to apply config file %q: %w", cfgPath, err)
 	}
 	if err := system.StartService("k3s"); err != nil {
 		return err
 	}
 	fmt.Println("Started service k3s.")
+	runCommands(cfg.RunCommands, config.AfterK3sStage)
 	return nil
 }
+
+// waitNodeKey waits for the node key that unseals the secrets in the config to be installed, either pushed with
+// "hc node push-key" or moved from a removable medium written by "hc node write-key" and attached after the boot.
+// Until then, only the parts of the config that don't need the secrets are applied so that the node can be reached
+// over SSH on the wired network to push the key.
+func waitNodeKey(cfg config.Config, keyPath string) {
+	if _, err := os.Stat(keyPath); err == nil {
+		return
+	}
+	for _, apply := range []func() error{
+		func() error { return applySSHAuthorizedKeys(cfg.SSHAuthorizedKeys) },
+		func() error { return applyHostname(cfg.Hostname) },
+		func() error { return applyInterfaces(cfg.Network.Interfaces, "/") },
+	} {
+		if err := apply(); err != nil {
+			fmt.Printf("Unable to apply config before the node key is installed: %v\n", err)
+		}
+	}
+	fmt.Printf("Waiting for node key %s to unseal the secrets in the config...\n", keyPath)
+	for {
+		if _, err := os.Stat(keyPath); err == nil {
+			fmt.Println("Node key has been installed.")
+			return
+		}
+		moved, err := system.MoveFileFromDevice(nodeKeyMediumLabel, config.NodeKeyFilename, keyPath)
+		if err != nil {
+			fmt.Printf("Unable to install node key from the %s medium: %v\n", nodeKeyMediumLabel, err)
+		} else if moved {
+			fmt.Printf("Node key has been installed from the %s medium.\n", nodeKeyMediumLabel)
+			return
+		}
+		time.Sleep(nodeKeyPollInterval)
+	}
+}
@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/psviderski/homecloud/internal/system"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runOnceDir stores markers of the commands with the once flag that have succeeded. It must be on a persistent
+// partition to survive reboots.
+const runOnceDir = "/usr/local/hcos/run-once"
+
+// applyWriteFiles writes the files from the config. Files in append mode are only appended to if they don't already
+// contain the content so that applying the config on every boot is idempotent.
+func applyWriteFiles(files []config.WriteFileConfig, root string) error {
+	for _, f := range files {
+		if err := writeFile(f, root); err != nil {
+			return fmt.Errorf("failed to write file %q: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+func writeFile(f config.WriteFileConfig, root string) error {
+	content := []byte(f.Content)
+	if f.Encoding == config.FileEncodingBase64 {
+		var err error
+		if content, err = base64.StdEncoding.DecodeString(f.Content); err != nil {
+			return fmt.Errorf("invalid base64 content: %w", err)
+		}
+	}
+	perm := os.FileMode(0644)
+	if f.Permissions != "" {
+		p, err := strconv.ParseUint(f.Permissions, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid permissions %q: %w", f.Permissions, err)
+		}
+		perm = fileMode(uint32(p))
+	}
+	filePath := path.Join(root, f.Path)
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	if f.Append {
+		current, err := os.ReadFile(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if bytes.Contains(current, content) {
+			fmt.Printf("File %s already contains the content, skipping.\n", f.Path)
+			return nil
+		}
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(content); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	} else if err := os.WriteFile(filePath, content, perm); err != nil {
+		return err
+	}
+	if f.Owner != "" {
+		uid, gid, err := lookupOwner(f.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(filePath, uid, gid); err != nil {
+			return err
+		}
+	}
+	// WriteFile doesn't change the permissions of an existing file. The permissions are set after changing the owner
+	// as chown clears the setuid and setgid bits.
+	if err := os.Chmod(filePath, perm); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote file %s.\n", f.Path)
+	return nil
+}
+
+// fileMode converts the numeric Unix permissions to os.FileMode which uses its own bits for setuid, setgid and sticky.
+func fileMode(perm uint32) os.FileMode {
+	mode := os.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// lookupOwner returns the UID and GID of the owner in the user[:group] form. The primary group of the user is used
+// if the group is not specified.
+func lookupOwner(owner string) (int, int, error) {
+	username, group, hasGroup := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(username)
+	gid := -1
+	if err != nil {
+		user, err := system.GetUser(username)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, gid = user.Uid, user.Gid
+	}
+	if hasGroup {
+		if gid, err = strconv.Atoi(group); err != nil {
+			if gid, err = system.GetGroupID(group); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// runCommands runs the commands for the stage. Failed commands are reported but don't prevent the following ones
+// from running so that a broken customisation doesn't keep the node out of the cluster.
+func runCommands(commands []config.RunCommandConfig, stage config.CommandStage) {
+	for _, c := range commands {
+		if c.StageOrDefault() != stage {
+			continue
+		}
+		sum := sha256.Sum256([]byte(string(stage) + "\n" + c.Command))
+		marker := path.Join(runOnceDir, hex.EncodeToString(sum[:]))
+		if c.Once {
+			if _, err := os.Stat(marker); err == nil {
+				fmt.Printf("Command %q has already succeeded once, skipping.\n", c.Command)
+				continue
+			}
+		}
+		if err := runCommand(c); err != nil {
+			fmt.Printf("Command %q failed: %v\n", c.Command, err)
+			continue
+		}
+		if c.Once {
+			err := os.MkdirAll(runOnceDir, 0755)
+			if err == nil {
+				err = os.WriteFile(marker, []byte(c.Command+"\n"), 0644)
+			}
+			if err != nil {
+				fmt.Printf("Unable to record that command %q succeeded: %v\n", c.Command, err)
+			}
+		}
+	}
+}
+
+func runCommand(c config.RunCommandConfig) error {
+	timeout, err := c.TimeoutOrDefault()
+	if err != nil {
+		return fmt.Errorf("invalid timeout %q: %w", c.Timeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	fmt.Printf("Running command %q...\n", c.Command)
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, "/bin/sh", "-c", c.Command).CombinedOutput()
+	if len(out) > 0 {
+		fmt.Printf("%s", out)
+		if out[len(out)-1] != '\n' {
+			fmt.Println()
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Command %q succeeded in %s.\n", c.Command, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/system"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	zoneInfoDir       = "/usr/share/zoneinfo"
+	localtimePath     = "/etc/localtime"
+	timezonePath      = "/etc/timezone"
+	defaultTimezone   = "UTC"
+	localeProfilePath = "/etc/profile.d/hcos-locale.sh"
+	// sysctlConfPath and modulesConfPath are read by the sysctl and modules services early at boot. Their
+	// directories are persistent so the settings are applied before the agent starts.
+	sysctlConfPath  = "/etc/sysctl.d/99-hcos.conf"
+	modulesConfPath = "/etc/modules-load.d/hcos.conf"
+)
+
+// applySystem applies the system settings. A setting that fails to be applied, e.g. a kernel module missing from
+// the kernel or a read-only kernel parameter, doesn't prevent applying the others, all the failures are returned
+// at the end.
+func applySystem(cfg config.SystemConfig, root string) error {
+	var failed []string
+	for _, err := range []error{
+		applyTimezone(cfg.Timezone, root),
+		applyLocale(cfg.Locale, root),
+		applyKernelModules(cfg.KernelModules, root),
+		applySysctl(cfg.Sysctl, root),
+	} {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to apply system settings: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// applyTimezone sets the time zone of the system. It's applied on every boot as /etc is not persistent so the services
+// started before the agent, e.g. the system logger, use UTC.
+func applyTimezone(timezone string, root string) error {
+	localtime := path.Join(root, localtimePath)
+	if timezone == "" {
+		timezone = defaultTimezone
+		// musl falls back to UTC if /etc/localtime doesn't exist, e.g. when the zoneinfo database isn't installed.
+		if _, err := os.Stat(path.Join(root, zoneInfoDir, timezone)); os.IsNotExist(err) {
+			if err := writeOrRemove(localtime, "", false, 0); err != nil {
+				return err
+			}
+			return writeOrRemove(path.Join(root, timezonePath), "", false, 0)
+		}
+	}
+	zoneInfo := path.Join(zoneInfoDir, timezone)
+	if _, err := os.Stat(path.Join(root, zoneInfo)); err != nil {
+		return fmt.Errorf("unknown time zone %q: %w", timezone, err)
+	}
+	if target, err := os.Readlink(localtime); err == nil && target == zoneInfo {
+		return nil
+	}
+	if err := os.Remove(localtime); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(zoneInfo, localtime); err != nil {
+		return fmt.Errorf("unable to set time zone: %w", err)
+	}
+	if err := os.WriteFile(path.Join(root, timezonePath), []byte(timezone+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", timezonePath, err)
+	}
+	fmt.Printf("Time zone has been set to %s.\n", timezone)
+	return nil
+}
+
+// applyLocale sets the locale of the login shells started after the config is applied. Like the time zone, it's
+// applied on every boot as /etc is not persistent.
+func applyLocale(locale string, root string) error {
+	return writeOrRemove(path.Join(root, localeProfilePath),
+		fmt.Sprintf("export LANG=%s\nexport LC_ALL=%s\n", locale, locale), locale != "", 0644)
+}
+
+func applyKernelModules(modules []string, root string) error {
+	if err := writeOrRemove(path.Join(root, modulesConfPath), strings.Join(modules, "\n")+"\n",
+		len(modules) > 0, 0644); err != nil {
+		return err
+	}
+	var failed []string
+	for _, m := range modules {
+		if err := system.LoadKernelModule(m); err != nil {
+			fmt.Printf("Unable to load kernel module %s: %v\n", m, err)
+			failed = append(failed, err.Error())
+			continue
+		}
+		fmt.Printf("Loaded kernel module %s.\n", m)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func applySysctl(params map[string]string, root string) error {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var content strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&content, "%s = %s\n", key, params[key])
+	}
+	confPath := path.Join(root, sysctlConfPath)
+	if err := writeOrRemove(confPath, content.String(), len(params) > 0, 0644); err != nil {
+		return err
+	}
+	var failed []string
+	for _, key := range keys {
+		if err := system.SetSysctl(key, params[key]); err != nil {
+			fmt.Printf("Unable to set kernel parameter %s: %v\n", key, err)
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	if len(params) > 0 {
+		fmt.Printf("Set %d kernel parameters.\n", len(params))
+	}
+	return nil
+}
+
+// writeOrRemove writes the file if write is true, otherwise removes the file if it exists.
+func writeOrRemove(filePath, content string, write bool, perm os.FileMode) error {
+	if !write {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove %q: %w", filePath, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath, []byte(content), perm); err != nil {
+		return fmt.Errorf("unable to write %q: %w", filePath, err)
+	}
+	return nil
+}
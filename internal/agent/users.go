@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/internal/system"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// managedUserGecos marks the users created by the agent so that they can be deleted when they are no longer
+	// declared in the config. Users that existed before, e.g. the ones shipped with the image, are never deleted.
+	managedUserGecos  = "hcos managed user"
+	doasUsersConfPath = "/etc/doas.d/hcos-users.conf"
+	// managedUsersPath lists the users declared in the last applied config. Unlike /etc/passwd, it's on a persistent
+	// partition so that the home directories of the users removed from the config before a reboot are deleted too.
+	managedUsersPath = "/usr/local/hcos/users"
+	homeDir          = "/home"
+)
+
+// applyUsers creates or updates the declared users, deletes the managed users that are no longer declared, and
+// writes doas rules for the users. A user that fails to be configured doesn't prevent configuring the others, all
+// the failures are returned at the end.
+func applyUsers(users []config.UserConfig, root string, secrets *config.SecretResolver) error {
+	existing, err := system.ListUsers()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]system.UserEntry, len(existing))
+	for _, e := range existing {
+		entries[e.Username] = e
+	}
+	declared := make(map[string]bool, len(users))
+	var (
+		applied []config.UserConfig
+		failed  []string
+	)
+	for _, u := range users {
+		declared[u.Name] = true
+		if err := applyUser(u, entries, secrets); err != nil {
+			fmt.Printf("Failed to configure user %s: %v\n", u.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", u.Name, err))
+			continue
+		}
+		applied = append(applied, u)
+	}
+	for _, e := range existing {
+		if e.Gecos == managedUserGecos && !declared[e.Username] {
+			if err := system.DeleteUser(e.Username); err != nil {
+				return err
+			}
+			fmt.Printf("Deleted user %s that is no longer declared in the config.\n", e.Username)
+		}
+	}
+	if err := deleteStaleHomes(declared, entries, root); err != nil {
+		return err
+	}
+	// Users that failed to be configured don't get the doas privileges, e.g. if they aren't managed by the agent.
+	if err := applyDoasRules(applied, root); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to configure users: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// deleteStaleHomes deletes the home directories of the users declared in the previously applied config that are
+// neither declared now nor exist in /etc/passwd, e.g. because they were removed from the config before a reboot.
+// The list of the managed users is then updated.
+func deleteStaleHomes(declared map[string]bool, entries map[string]system.UserEntry, root string) error {
+	statePath := path.Join(root, managedUsersPath)
+	data, err := os.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read managed users %q: %w", statePath, err)
+	}
+	for _, name := range strings.Fields(string(data)) {
+		if _, ok := entries[name]; ok || declared[name] {
+			continue
+		}
+		home := path.Join(root, homeDir, name)
+		if _, err := os.Stat(home); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(home); err != nil {
+			return fmt.Errorf("unable to delete home directory %q: %w", home, err)
+		}
+		fmt.Printf("Deleted home directory of user %s that is no longer declared in the config.\n", name)
+	}
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := os.MkdirAll(path.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(statePath, []byte(strings.Join(names, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write managed users %q: %w", statePath, err)
+	}
+	return nil
+}
+
+func applyUser(u config.UserConfig, entries map[string]system.UserEntry, secrets *config.SecretResolver) error {
+	shell := u.ShellOrDefault()
+	uid := u.UIDOrDefault()
+	if entry, ok := entries[u.Name]; ok && entry.Gecos != managedUserGecos {
+		return fmt.Errorf("user %s already exists and is not managed by the agent", u.Name)
+	}
+	if entry, ok := entries[u.Name]; !ok {
+		if err := system.CreateUser(u.Name, uid, shell, managedUserGecos); err != nil {
+			return err
+		}
+		// The home directory persisted from the previous boot may be owned by a different UID, e.g. if the uid
+		// has been changed in the config.
+		created, err := system.GetUser(u.Name)
+		if err != nil {
+			return err
+		}
+		if err := system.ChownHome(created); err != nil {
+			return fmt.Errorf("unable to change owner of home directory %q: %w", created.HomeDir, err)
+		}
+		fmt.Printf("Created user %s with UID %d.\n", u.Name, uid)
+	} else if entry.Uid != uid {
+		// The UID is only changed when the user is re-created, i.e. on the next boot as /etc/passwd is ephemeral.
+		fmt.Printf("User %s has UID %d instead of %d, the UID will be changed after a reboot.\n",
+			u.Name, entry.Uid, uid)
+	}
+	if entry, ok := entries[u.Name]; ok && entry.Shell != shell {
+		if err := system.SetShell(u.Name, shell); err != nil {
+			return err
+		}
+	}
+	if err := system.SetUserGroups(u.Name, u.Groups); err != nil {
+		return err
+	}
+	switch {
+	case u.Lock:
+		if err := system.LockUser(u.Name); err != nil {
+			return err
+		}
+	case u.Password != "":
+		password, err := secrets.Resolve(u.Password)
+		if err != nil {
+			return fmt.Errorf("unable to resolve password: %w", err)
+		}
+		if err := system.SetPassword(u.Name, password); err != nil {
+			return err
+		}
+	default:
+		if err := system.DisablePassword(u.Name); err != nil {
+			return err
+		}
+	}
+	return system.SetAuthorizedKeys(u.Name, u.SSHAuthorizedKeys)
+}
+
+// applyDoasRules writes the doas rules that allow the users to run commands as root.
+func applyDoasRules(users []config.UserConfig, root string) error {
+	var rules strings.Builder
+	for _, u := range users {
+		if u.Lock {
+			continue
+		}
+		switch u.DoasOrDefault() {
+		case config.DoasPassword:
+			fmt.Fprintf(&rules, "permit persist %s as root\n", u.Name)
+		case config.DoasNoPass:
+			fmt.Fprintf(&rules, "permit nopass %s as root\n", u.Name)
+		}
+	}
+	confPath := path.Join(root, doasUsersConfPath)
+	if rules.Len() == 0 {
+		if err := os.Remove(confPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove doas config %q: %w", confPath, err)
+		}
+		return nil
+	}
+	content := "# Managed by Home Cloud OS agent, changes will be overwritten.\n" + rules.String()
+	// doas refuses to use a config file that is writable by other users.
+	if err := os.WriteFile(confPath, []byte(content), 0600); err != nil {
+		return fmt.Errorf("unable to write doas config %q: %w", confPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/psviderski/homecloud/internal/k3s"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// defaultLoginUsername is a login user on HCOS nodes.
+const defaultLoginUsername = "hc"
+
+// AdoptRequest describes an already running node to add to the store.
+type AdoptRequest struct {
+	Name        string
+	ClusterName string
+	// Host is a host to connect to over SSH in the [user@]host[:port] format. The default user is hc.
+	Host string
+	// SSHKey is a path to the SSH private key to connect to the host with. The cluster SSH key is used by default.
+	SSHKey string
+}
+
+// tailscaleStatus is a subset of the `tailscale status --json` output.
+type tailscaleStatus struct {
+	Self struct {
+		HostName string `json:"HostName"`
+	} `json:"Self"`
+}
+
+// AdoptNode connects to a running node installed without hc (or lost from the store) over SSH, verifies that it
+// belongs to the cluster, and creates a node record for it in the store.
+func (c *Client) AdoptNode(req AdoptRequest) (Node, error) {
+	cluster, err := c.GetCluster(req.ClusterName)
+	if err != nil {
+		return Node{}, err
+	}
+	if err := c.validateNodeName(cluster.Name, req.Name); err != nil {
+		return Node{}, err
+	}
+	host := req.Host
+	if !strings.Contains(host, "@") {
+		host = defaultLoginUsername + "@" + host
+	}
+	client, err := dialNode(c.Store, cluster.Name, host, req.SSHKey)
+	if err != nil {
+		return Node{}, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer client.Close()
+	// HCOS ships doas-sudo-shim so sudo works on both HCOS and other Linux hosts.
+	sudo := sudoPrefix(host)
+
+	out, err := client.Run(sudo+"cat "+k3s.ConfigPath, nil)
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to read k3s config %s: %w", k3s.ConfigPath, err)
+	}
+	var k3sCfg k3s.Config
+	if err := yaml.Unmarshal([]byte(out), &k3sCfg); err != nil {
+		return Node{}, fmt.Errorf("unable to parse k3s config %s: %w", k3s.ConfigPath, err)
+	}
+	if k3sCfg.Token != cluster.Token {
+		return Node{}, fmt.Errorf("node doesn't belong to cluster %q: k3s token doesn't match the cluster token",
+			cluster.Name)
+	}
+
+	out, err = client.Run(sudo+"tailscale status --json", nil)
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to get Tailscale status: %w", err)
+	}
+	var tsStatus tailscaleStatus
+	if err := json.Unmarshal([]byte(out), &tsStatus); err != nil {
+		return Node{}, fmt.Errorf("unable to parse Tailscale status: %w", err)
+	}
+
+	node := Node{
+		Name:        req.Name,
+		ClusterName: cluster.Name,
+	}
+	// The OS config only exists on HCOS nodes, other hosts are managed by the ssh provider.
+	out, err = client.Run(fmt.Sprintf("[ ! -f %[2]s ] || %[1]scat %[2]s", sudo, config.DefaultConfigPath), nil)
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to read OS config %s: %w", config.DefaultConfigPath, err)
+	}
+	if strings.TrimSpace(out) != "" {
+		if node.OSConfig, err = config.ParseConfig([]byte(out), false); err != nil {
+			return Node{}, fmt.Errorf("unable to parse OS config %s: %w", config.DefaultConfigPath, err)
+		}
+		// Sealed secrets are stored unsealed along with the node key so that the config can be re-sealed when
+		// the node is reconfigured. A sealed config is never stored without its key.
+		if node.OSConfig.HasSealedSecrets() {
+			key, err := client.Run(sudo+"cat "+config.DefaultNodeKeyPath, nil)
+			if err != nil {
+				return Node{}, fmt.Errorf("failed to read node key %s to unseal the OS config secrets: %w",
+					config.DefaultNodeKeyPath, err)
+			}
+			node.SecretKey = []byte(key)
+			if node.OSConfig, err = node.OSConfig.UnsealSecrets(node.SecretKey); err != nil {
+				return Node{}, fmt.Errorf("unable to unseal OS config secrets: %w", err)
+			}
+		}
+		// The token has already been checked in the k3s config, it can only differ here if the OS config refers to
+		// a secret that is resolved on the node.
+		if token := node.OSConfig.K3s.Token; !config.IsSecretRef(token) && token != cluster.Token {
+			return Node{}, fmt.Errorf("node doesn't belong to cluster %q: k3s token in the OS config doesn't "+
+				"match the cluster token", cluster.Name)
+		}
+		arch, err := client.Run("uname -m", nil)
+		if err != nil {
+			return Node{}, err
+		}
+		switch strings.TrimSpace(arch) {
+		case "aarch64":
+			node.Provider = RPi4Provider
+		case "x86_64":
+			node.Provider = AMD64Provider
+		default:
+			return Node{}, fmt.Errorf("unsupported HCOS node architecture: %s", arch)
+		}
+	} else {
+		node.Provider = SSHProvider
+		node.Options = map[string]string{HostOption: host}
+		if req.SSHKey != "" {
+			node.Options[SSHKeyOption] = req.SSHKey
+		}
+		node.OSConfig = config.Config{
+			Version:  config.CurrentVersion,
+			Hostname: tsStatus.Self.HostName,
+			K3s: config.K3sConfig{
+				Role:   adoptedK3sRole(k3sCfg),
+				Server: k3sCfg.Server,
+				Token:  k3sCfg.Token,
+			},
+		}
+	}
+	if node.OSConfig.Hostname == "" {
+		return Node{}, fmt.Errorf("unable to determine the node hostname")
+	}
+
+	if node.Role() == config.ClusterInitRole {
+		nodes, err := c.ListNodes(cluster.Name)
+		if err != nil {
+			return Node{}, err
+		}
+		for _, n := range nodes {
+			if n.Role() == config.ClusterInitRole {
+				return Node{}, fmt.Errorf("cluster %q already has cluster-init node %q", cluster.Name, n.Name)
+			}
+		}
+	}
+	if err := c.saveNewNode(&cluster, node); err != nil {
+		return Node{}, err
+	}
+	return node, nil
+}
+
+// adoptedK3sRole determines the node role from the k3s config generated by hc. Only control plane nodes bind to
+// the Tailscale IP, see k3s.NewConfig.
+func adoptedK3sRole(cfg k3s.Config) config.K3sRole {
+	switch {
+	case cfg.ClusterInit || cfg.Server == "":
+		return config.ClusterInitRole
+	case cfg.BindAddress != "":
+		return config.ControlPlaneRole
+	default:
+		return config.WorkerRole
+	}
+}
@@ -0,0 +1,373 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	AMD64Provider = "amd64"
+
+	// OutputOption is a file path to write the node image to instead of a disk device.
+	OutputOption = "output"
+
+	sectorSize = 512
+)
+
+func init() {
+	RegisterProvider(amd64Provider{})
+}
+
+// amd64Provider provisions x86-64 machines, e.g. Intel NUCs, by preparing a bootable HCOS image with the OS config
+// embedded and writing it to a USB stick or an image file. The OS config is put on a small FAT partition labelled
+// HCOS_CONFIG that is appended to the image. The OS picks it up on boot the same way as the config drive of VMs.
+// The secrets in the config are sealed to the node key that is not embedded in the image. It must be written to
+// a removable medium with Client.WriteNodeKey or pushed over SSH with Client.PushNodeKey.
+type amd64Provider struct{}
+
+func (amd64Provider) Describe() ProviderInfo {
+	return ProviderInfo{
+		Name:  AMD64Provider,
+		Title: "x86-64 (amd64)",
+		Wifi:  true,
+		Options: []ProviderOption{
+			{
+				Name:     ImageOption,
+				Usage:    "Path to the Home Cloud OS amd64 image to use for the node (.img, .img.xz, or .iso)",
+				Required: true,
+			},
+			{
+				Name: DiskOption,
+				Usage: "Disk device (e.g. USB stick) to write the node image to (e.g. /dev/disk4 or /dev/sdb). " +
+					"Please use with caution as all data on the device will be destroyed!",
+			},
+			{
+				Name:  OutputOption,
+				Usage: "File path to write the node image to instead of a disk device",
+			},
+		},
+	}
+}
+
+func (amd64Provider) ValidateRequest(req NodeRequest) error {
+	if (req.Options[DiskOption] == "") == (req.Options[OutputOption] == "") {
+		return fmt.Errorf("either %s or %s option must be specified", DiskOption, OutputOption)
+	}
+	return nil
+}
+
+func (amd64Provider) RenderOSConfig(cfg config.Config, _ NodeRequest) (config.Config, error) {
+	return cfg, nil
+}
+
+func (amd64Provider) Provision(_ *Store, node Node, req NodeRequest) (Node, error) {
+	imagePath, disk := req.Options[ImageOption], req.Options[DiskOption]
+	if _, err := os.Stat(imagePath); err != nil {
+		return Node{}, err
+	}
+	tmpDir, err := os.MkdirTemp("", "hc-amd64-")
+	if err != nil {
+		return Node{}, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(tmpDir)
+	drivePath := filepath.Join(tmpDir, "config.img")
+	if node, err = createConfigDrive(node, drivePath); err != nil {
+		return Node{}, err
+	}
+
+	output := req.Options[OutputOption]
+	if output == "" {
+		// Prepare the image in a temporary file before writing it to the disk.
+		output = filepath.Join(tmpDir, "image")
+	}
+	if strings.HasSuffix(imagePath, ".iso") {
+		err = embedISOConfig(imagePath, drivePath, output)
+	} else {
+		err = embedRawConfig(imagePath, drivePath, output)
+	}
+	if err != nil {
+		return Node{}, err
+	}
+	if disk != "" {
+		if err := writeImageFile(output, disk); err != nil {
+			return Node{}, err
+		}
+	}
+	return node, nil
+}
+
+// Deprovision does nothing as the node disk is not accessible remotely. It should be wiped manually if needed.
+func (amd64Provider) Deprovision(*Store, Node) error {
+	return nil
+}
+
+// configPartitionNumber is a number of the config partition appended to ISO images. The first partitions of hybrid
+// ISO images are usually taken by the ISO file system itself and the EFI system partition.
+const configPartitionNumber = "3"
+
+// embedISOConfig creates a copy of the ISO image with the config drive appended as a partition. The partition is only
+// visible when the image is written to a disk, e.g. a USB stick, rather than attached as a CD-ROM.
+func embedISOConfig(isoPath, drivePath, output string) error {
+	if _, err := exec.LookPath("xorriso"); err != nil {
+		return fmt.Errorf("%w. Please install xorriso, e.g. using `brew install xorriso` or `apt-get install xorriso`",
+			err)
+	}
+	// Replay the boot setup of the original ISO to keep the resulting image bootable.
+	cmd := exec.Command("xorriso", "-indev", isoPath, "-outdev", output, "-boot_image", "any", "replay",
+		"-append_partition", configPartitionNumber, fmt.Sprintf("0x%02x", fat12PartitionType), drivePath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to append config partition to ISO image: %w: %s", err, out)
+	}
+	return nil
+}
+
+// embedRawConfig creates a copy of the raw disk image (optionally compressed with xz) with the config drive appended
+// as a partition.
+func embedRawConfig(imagePath, drivePath, output string) error {
+	if err := copyImage(imagePath, output); err != nil {
+		return err
+	}
+	return appendPartition(output, drivePath)
+}
+
+// copyImage copies the image to the output file decompressing it if it's compressed with xz.
+func copyImage(imagePath, output string) error {
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer out.Close()
+	if strings.HasSuffix(imagePath, ".xz") {
+		if err := checkImage(imagePath); err != nil {
+			return err
+		}
+		cmd := exec.Command("xz", "--decompress", "--stdout", imagePath)
+		cmd.Stdout = out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to decompress image: %w", err)
+		}
+		return out.Close()
+	}
+	in, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer in.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	return out.Close()
+}
+
+const (
+	// fat12PartitionType is the MBR partition type of the config partition.
+	fat12PartitionType = 0x01
+	// partitionAlignment is the alignment of the appended partition in sectors (1 MiB).
+	partitionAlignment = 2048
+	// gptEntriesSectors is the number of sectors taken by the standard GPT partition entries array (128 * 128 bytes).
+	gptEntriesSectors = 32
+)
+
+// basicDataPartitionGUID is the GPT partition type GUID "Microsoft basic data" (EBD0A0A2-B9E5-4433-87C0-68B6B72699C7)
+// in its on-disk mixed-endian encoding.
+var basicDataPartitionGUID = []byte{
+	0xA2, 0xA0, 0xD0, 0xEB, 0xE5, 0xB9, 0x33, 0x44, 0x87, 0xC0, 0x68, 0xB6, 0xB7, 0x26, 0x99, 0xC7,
+}
+
+// appendPartition appends the partition data to the end of the disk image and adds a partition entry for it to the
+// image MBR or GPT partition table. 512-byte sectors are assumed.
+func appendPartition(imagePath, partPath string) error {
+	data, err := os.ReadFile(partPath)
+	if err != nil {
+		return err
+	}
+	// Pad the partition data to whole sectors.
+	if rem := len(data) % sectorSize; rem != 0 {
+		data = append(data, make([]byte, sectorSize-rem)...)
+	}
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	imageSectors := uint64((info.Size() + sectorSize - 1) / sectorSize)
+	mbr := make([]byte, sectorSize)
+	if _, err := io.ReadFull(f, mbr); err != nil {
+		return fmt.Errorf("unable to read partition table: %w", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return fmt.Errorf("image %q doesn't have a valid partition table", imagePath)
+	}
+	if mbr[446+4] == 0xEE {
+		err = appendGPTPartition(f, mbr, data)
+	} else {
+		err = appendMBRPartition(f, mbr, imageSectors, data)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to append config partition to image %q: %w", imagePath, err)
+	}
+	return f.Close()
+}
+
+func appendMBRPartition(f *os.File, mbr []byte, imageSectors uint64, data []byte) error {
+	free := -1
+	end := imageSectors
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		if entry[4] == 0 {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+		start := uint64(binary.LittleEndian.Uint32(entry[8:12]))
+		size := uint64(binary.LittleEndian.Uint32(entry[12:16]))
+		if start+size > end {
+			end = start + size
+		}
+	}
+	if free < 0 {
+		return fmt.Errorf("all four primary MBR partitions are already used")
+	}
+	start := alignUp(end, partitionAlignment)
+	size := uint64(len(data) / sectorSize)
+	if start+size > 0xFFFFFFFF {
+		return fmt.Errorf("image is too large for an MBR partition table")
+	}
+	if _, err := f.WriteAt(data, int64(start)*sectorSize); err != nil {
+		return err
+	}
+	entry := mbr[446+free*16 : 446+(free+1)*16]
+	// Not bootable, CHS addresses are set to the maximum values to use LBA.
+	copy(entry, []byte{0x00, 0xFE, 0xFF, 0xFF, fat12PartitionType, 0xFE, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(size))
+	_, err := f.WriteAt(mbr, 0)
+	return err
+}
+
+func appendGPTPartition(f *os.File, mbr []byte, data []byte) error {
+	header := make([]byte, sectorSize)
+	if _, err := f.ReadAt(header, sectorSize); err != nil {
+		return fmt.Errorf("unable to read GPT header: %w", err)
+	}
+	if string(header[:8]) != "EFI PART" {
+		return fmt.Errorf("invalid GPT header")
+	}
+	headerSize := binary.LittleEndian.Uint32(header[12:16])
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	numEntries := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+	if headerSize < 92 || headerSize > sectorSize || entrySize < 128 ||
+		uint64(numEntries)*uint64(entrySize) != gptEntriesSectors*sectorSize {
+		return fmt.Errorf("unsupported GPT layout")
+	}
+	entries := make([]byte, gptEntriesSectors*sectorSize)
+	if _, err := f.ReadAt(entries, int64(entriesLBA)*sectorSize); err != nil {
+		return fmt.Errorf("unable to read GPT partition entries: %w", err)
+	}
+
+	free := -1
+	// The backup GPT at the end of the image is replaced so the partition can take its place.
+	end := binary.LittleEndian.Uint64(header[48:56]) + 1
+	for i := 0; i < int(numEntries); i++ {
+		entry := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+		if last := binary.LittleEndian.Uint64(entry[40:48]); last+1 > end {
+			end = last + 1
+		}
+	}
+	if free < 0 {
+		return fmt.Errorf("all GPT partition entries are already used")
+	}
+	start := alignUp(end, partitionAlignment)
+	size := uint64(len(data) / sectorSize)
+	if _, err := f.WriteAt(data, int64(start)*sectorSize); err != nil {
+		return err
+	}
+
+	entry := entries[free*int(entrySize) : (free+1)*int(entrySize)]
+	copy(entry[0:16], basicDataPartitionGUID)
+	if _, err := rand.Read(entry[16:32]); err != nil {
+		return err
+	}
+	// Set the version 4 (random) GUID bits.
+	entry[16+7] = entry[16+7]&0x0F | 0x40
+	entry[16+8] = entry[16+8]&0x3F | 0x80
+	binary.LittleEndian.PutUint64(entry[32:40], start)
+	binary.LittleEndian.PutUint64(entry[40:48], start+size-1)
+	binary.LittleEndian.PutUint64(entry[48:56], 0)
+	name := utf16.Encode([]rune(configDriveLabel))
+	for i, c := range name {
+		binary.LittleEndian.PutUint16(entry[56+i*2:58+i*2], c)
+	}
+
+	// The backup partition entries and header are placed right after the appended partition.
+	backupEntriesLBA := start + size
+	backupHeaderLBA := backupEntriesLBA + gptEntriesSectors
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	writeHeader := func(myLBA, alternateLBA, entriesLBA uint64) error {
+		h := make([]byte, sectorSize)
+		copy(h, header[:headerSize])
+		binary.LittleEndian.PutUint64(h[24:32], myLBA)
+		binary.LittleEndian.PutUint64(h[32:40], alternateLBA)
+		binary.LittleEndian.PutUint64(h[48:56], backupEntriesLBA-1)
+		binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(h[88:92], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:20], 0)
+		binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:headerSize]))
+		_, err := f.WriteAt(h, int64(myLBA)*sectorSize)
+		return err
+	}
+	if _, err := f.WriteAt(entries, int64(entriesLBA)*sectorSize); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(entries, int64(backupEntriesLBA)*sectorSize); err != nil {
+		return err
+	}
+	if err := writeHeader(1, backupHeaderLBA, entriesLBA); err != nil {
+		return err
+	}
+	if err := writeHeader(backupHeaderLBA, 1, backupEntriesLBA); err != nil {
+		return err
+	}
+	// Update the size of the protective MBR partition to cover the whole image.
+	protectiveSize := backupHeaderLBA
+	if protectiveSize > 0xFFFFFFFF {
+		protectiveSize = 0xFFFFFFFF
+	}
+	binary.LittleEndian.PutUint32(mbr[446+12:446+16], uint32(protectiveSize))
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+	// Drop the old backup GPT if it was located after the new one.
+	return f.Truncate(int64(backupHeaderLBA+1) * sectorSize)
+}
+
+func alignUp(n, alignment uint64) uint64 {
+	return (n + alignment - 1) / alignment * alignment
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/psviderski/homecloud/internal/k3s"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+const (
+	CloudInitProvider = "cloudinit"
+
+	// cloudInitUsername is a login user created on cloud-init nodes, the same as the default user on HCOS nodes.
+	cloudInitUsername = "hc"
+)
+
+func init() {
+	RegisterProvider(cloudInitProvider{})
+}
+
+// cloudInitProvider renders a cloud-init user-data document that installs Tailscale and K3s on the first boot of
+// a cloud VM so that it joins the cluster. The document can be pasted into a cloud console or put on a NoCloud seed
+// ISO. See https://cloudinit.readthedocs.io/en/latest/topics/examples.html
+// Unlike the HCOS configs, the document contains the secrets (Tailscale auth key, k3s token) in plaintext as
+// cloud-init can't unseal them, so it must be kept private.
+type cloudInitProvider struct{}
+
+// cloudInitUserData is a subset of the cloud-init cloud-config format.
+type cloudInitUserData struct {
+	Hostname   string               `yaml:"hostname"`
+	Users      []interface{}        `yaml:"users"`
+	WriteFiles []cloudInitWriteFile `yaml:"write_files"`
+	RunCmd     []string             `yaml:"runcmd"`
+}
+
+type cloudInitUser struct {
+	Name              string   `yaml:"name"`
+	Shell             string   `yaml:"shell"`
+	Sudo              string   `yaml:"sudo"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
+
+type cloudInitWriteFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+func (cloudInitProvider) Describe() ProviderInfo {
+	return ProviderInfo{
+		Name:  CloudInitProvider,
+		Title: "cloud-init",
+		Options: []ProviderOption{
+			{
+				Name:  OutputOption,
+				Usage: "File path to write the cloud-init user-data to (default is print to stdout)",
+			},
+		},
+	}
+}
+
+func (cloudInitProvider) ValidateRequest(NodeRequest) error {
+	return nil
+}
+
+func (cloudInitProvider) RenderOSConfig(cfg config.Config, _ NodeRequest) (config.Config, error) {
+	return cfg, nil
+}
+
+func (cloudInitProvider) Provision(_ *Store, node Node, req NodeRequest) (Node, error) {
+	userData, err := renderCloudInitUserData(node.OSConfig)
+	if err != nil {
+		return Node{}, err
+	}
+	output := req.Options[OutputOption]
+	if output == "" || output == "-" {
+		fmt.Print(string(userData))
+		return node, nil
+	}
+	// The user-data contains secrets such as the Tailscale auth key and the cluster token.
+	if err := os.WriteFile(output, userData, 0600); err != nil {
+		return Node{}, fmt.Errorf("failed to write cloud-init user-data: %w", err)
+	}
+	return node, nil
+}
+
+// Deprovision does nothing as the cloud VM is managed outside of the cluster. It should be deleted manually.
+func (cloudInitProvider) Deprovision(*Store, Node) error {
+	return nil
+}
+
+// renderCloudInitUserData renders a cloud-init user-data document that configures the node according to
+// the OS config the same way as the OS agent does on HCOS nodes.
+func renderCloudInitUserData(osCfg config.Config) ([]byte, error) {
+	// The Tailscale IP is unknown until the node is connected to the tailnet so it's added on the node for
+	// the control plane roles.
+	k3sCfg, cmd, err := k3s.NewConfig(osCfg.K3s, "", "")
+	if err != nil {
+		return nil, err
+	}
+	k3sCfg.NodeName = osCfg.Hostname
+	k3sCfgYAML, err := yaml.Marshal(&k3sCfg)
+	if err != nil {
+		return nil, err
+	}
+	runCmd := []string{
+		fmt.Sprintf("curl -fsSL %s | sh", tailscaleInstallURL),
+		fmt.Sprintf("tailscale up --auth-key %s --hostname %s --timeout 60s",
+			shellQuote(osCfg.Network.Tailscale.AuthKey), shellQuote(osCfg.Hostname)),
+	}
+	if cmd == k3s.ServerCommand {
+		runCmd = append(runCmd,
+			fmt.Sprintf(`echo "bind-address: $(tailscale ip -4)" >> %s`, k3s.ConfigPath))
+	}
+	runCmd = append(runCmd, fmt.Sprintf("curl -sfL %s | INSTALL_K3S_EXEC=%s sh -", k3sInstallURL, cmd))
+
+	userData := cloudInitUserData{
+		Hostname: osCfg.Hostname,
+		Users: []interface{}{
+			"default",
+			cloudInitUser{
+				Name:              cloudInitUsername,
+				Shell:             "/bin/bash",
+				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+				SSHAuthorizedKeys: osCfg.SSHAuthorizedKeys,
+			},
+		},
+		WriteFiles: []cloudInitWriteFile{
+			{
+				Path:        k3s.ConfigPath,
+				Permissions: "0600",
+				Content:     string(k3sCfgYAML),
+			},
+		},
+		RunCmd: runCmd,
+	}
+	var data bytes.Buffer
+	data.WriteString("#cloud-config\n")
+	enc := yaml.NewEncoder(&data)
+	enc.SetIndent(2)
+	if err := enc.Encode(&userData); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
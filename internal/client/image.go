@@ -0,0 +1,508 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// installImage installs a raw disk image from the local file system on the specified block device.
+// The image file must be compressed with xz.
+func installImage(imagePath string, osCfg config.Config, device string) error {
+	if err := checkImage(imagePath); err != nil {
+		return err
+	}
+	// TODO: retrieve information about the disk and ask for user confirmation if it is correct.
+	useSudo, err := prepareDisk(device)
+	if err != nil {
+		return err
+	}
+	xzCmd := fmt.Sprintf("xz --decompress --stdout %q", imagePath)
+	ddCmd := fmt.Sprintf("dd of=%q status=progress", device)
+	if useSudo {
+		ddCmd = "sudo " + ddCmd
+		fmt.Println("Using sudo to write to the disk device. Please enter your user password if prompted.")
+	}
+	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("%s | %s", xzCmd, ddCmd))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to write image to disk %s: %w", device, err)
+	}
+	return writeOSConfig(osCfg, device)
+}
+
+// writeImageFile writes an uncompressed disk image file as is to the specified block device.
+func writeImageFile(imagePath string, device string) error {
+	useSudo, err := prepareDisk(device)
+	if err != nil {
+		return err
+	}
+	args := []string{"dd", "if=" + imagePath, "of=" + device, "bs=4194304", "status=progress"}
+	if useSudo {
+		args = append([]string{"sudo"}, args...)
+		fmt.Println("Using sudo to write to the disk device. Please enter your user password if prompted.")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write image to disk %s: %w", device, err)
+	}
+	return nil
+}
+
+// checkImage checks that the image file exists and can be decompressed.
+func checkImage(imagePath string) error {
+	if _, err := os.Stat(imagePath); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(imagePath, ".xz") {
+		// TODO: support uncompressed images.
+		return fmt.Errorf("image file must be compressed with xz")
+	}
+	if _, err := exec.LookPath("xz"); err != nil {
+		return fmt.Errorf("%w. Please install xz utils, e.g. using `brew install xz` or `apt-get install xz-utils`",
+			err)
+	}
+	return nil
+}
+
+// prepareDisk unmounts all disk partitions if any of them are mounted and returns whether sudo is required to write
+// to the disk device.
+func prepareDisk(device string) (bool, error) {
+	mounts, err := exec.Command("mount").CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(string(mounts), device) {
+		if err := unmountDisk(device); err != nil {
+			return false, err
+		}
+	}
+	if f, err := os.OpenFile(device, syscall.O_WRONLY, 0600); err == nil {
+		_ = f.Close()
+	} else if os.IsPermission(err) {
+		return true, nil
+	} else {
+		return false, err
+	}
+	return false, nil
+}
+
+// writeOSConfig writes the OS config to the boot partition of the disk with an installed HCOS image. The node key to
+// unseal its secrets is never written to the disk, it's delivered separately, see Client.PushNodeKey.
+func writeOSConfig(osCfg config.Config, device string) error {
+	// The first partition on a RPi4 disk is a FAT32 boot partition that is automatically mounted after writing
+	// the image. Note, it takes a moment to automount. See build_image_rpi4.sh for details on image layout.
+	path, err := waitPartitionMountPath(device + "s1")
+	if err != nil {
+		return err
+	}
+	if err := verifyBootPartition(device+"s1", path); err != nil {
+		return err
+	}
+	if err := osCfg.Write(filepath.Join(path, OSConfigFilename), 0600); err != nil {
+		return err
+	}
+	return unmountDisk(device)
+}
+
+// verifyBootPartition checks that the mounted partition is a boot partition of an HCOS image.
+func verifyBootPartition(device, path string) error {
+	label, err := getPartitionLabel(device)
+	if err != nil {
+		return err
+	}
+	if label != bootPartitionLabel {
+		return fmt.Errorf("disk partition %s is not an HCOS boot partition (label %s is expected)",
+			device, bootPartitionLabel)
+	}
+	// Files installed to the boot partition by the HCOS image build, see Earthfile.
+	for _, name := range []string{"config.txt", "u-boot.bin"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			return fmt.Errorf("disk partition %s doesn't contain an HCOS image: %w", device, err)
+		}
+	}
+	return nil
+}
+
+func getPartitionInfo(device string) (string, error) {
+	diskInfo, err := exec.Command("diskutil", "info", device).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get info for disk partition %s: %w", device, err)
+	}
+	return string(diskInfo), nil
+}
+
+// writeKeyMedium writes the node key to the first partition of a removable medium (e.g. USB flash drive) labelled
+// HCOS_KEY. The OS moves the key from the medium to the persistent partition when the medium is attached to the node.
+// The medium is formatted as FAT32 with the HCOS_KEY label first if format is true.
+func writeKeyMedium(key []byte, device string, format bool) error {
+	var cmd *exec.Cmd
+	if format {
+		cmd = exec.Command("diskutil", "eraseDisk", "FAT32", keyDriveLabel, "MBRFormat", device)
+	} else {
+		cmd = exec.Command("diskutil", "mountDisk", device)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	path, err := waitPartitionMountPath(device + "s1")
+	if err != nil {
+		return err
+	}
+	label, err := getPartitionLabel(device + "s1")
+	if err != nil {
+		return err
+	}
+	if label != keyDriveLabel {
+		return fmt.Errorf("disk partition %ss1 is not a node key partition (label %s is expected), "+
+			"format the disk to create it", device, keyDriveLabel)
+	}
+	if err := os.WriteFile(filepath.Join(path, config.NodeKeyFilename), key, 0600); err != nil {
+		return err
+	}
+	return unmountDisk(device)
+}
+
+// waitPartitionMountPath returns the mount path of the disk partition waiting for a moment for it to be automounted.
+func waitPartitionMountPath(device string) (string, error) {
+	path := ""
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		path, err = getPartitionMountPath(device)
+		if err != nil {
+			time.Sleep(time.Second)
+		} else {
+			break
+		}
+	}
+	return path, err
+}
+
+func getPartitionLabel(device string) (string, error) {
+	info, err := getPartitionInfo(device)
+	if err != nil {
+		return "", err
+	}
+	r := regexp.MustCompile(`Volume Name:\s+(.+)`)
+	match := r.FindStringSubmatch(info)
+	if match == nil {
+		return "", nil
+	}
+	return strings.TrimSpace(match[1]), nil
+}
+
+func getPartitionMountPath(device string) (string, error) {
+	diskInfo, err := getPartitionInfo(device)
+	if err != nil {
+		return "", err
+	}
+	r := regexp.MustCompile(`Mount Point:\s+(.+)`)
+	match := r.FindStringSubmatch(diskInfo)
+	if match == nil {
+		return "", fmt.Errorf("disk partition %s is not mounted", device)
+	}
+	return match[1], nil
+}
+
+func mountDisk(device string) error {
+	cmd := exec.Command("diskutil", "mountDisk", device)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func unmountDisk(device string) error {
+	cmd := exec.Command("diskutil", "unmountDisk", device)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// imageTarget is a disk device to install an image on and the OS config to write to its boot partition.
+type imageTarget struct {
+	device string
+	osCfg  config.Config
+}
+
+// bootPartitionLabel is a label of the boot partition in an HCOS image. See build_image_rpi4.sh for details.
+const bootPartitionLabel = "HCOS_BOOT"
+
+// configDriveLabel is a label of the FAT config drive attached to VMs or appended to amd64 images as a partition.
+// Keep the label in sync with the one defined in /overlay/common/system/oem/03_setup_config.yaml.
+const configDriveLabel = "HCOS_CONFIG"
+
+// keyDriveLabel is a label of the FAT drive attached to VMs or removable medium with the node key that unseals
+// the secrets in the OS config.
+// Keep the label in sync with the one defined in /overlay/common/system/oem/03_setup_config.yaml.
+const keyDriveLabel = "HCOS_KEY"
+
+// createConfigDrive creates a FAT file system image labelled HCOS_CONFIG with the OS config of the node at its root.
+// The OS moves the config from the config drive to the persistent partition on boot. The secrets in the config are
+// sealed to the node key that is generated if the node doesn't have one yet. The returned node has the key which is
+// never written to the config drive, it's delivered separately on a key drive or medium, see createKeyDrive.
+func createConfigDrive(node Node, path string) (Node, error) {
+	node, osCfg, err := sealNodeSecrets(node)
+	if err != nil {
+		return Node{}, err
+	}
+	data, err := osCfg.Marshal()
+	if err != nil {
+		return Node{}, err
+	}
+	if err := createFATDrive(path, configDriveLabel, OSConfigFilename, data); err != nil {
+		return Node{}, fmt.Errorf("failed to create config drive: %w", err)
+	}
+	return node, nil
+}
+
+// createKeyDrive creates a FAT file system image labelled HCOS_KEY with the node key at its root. The OS moves
+// the key from the key drive to the persistent partition on boot the same way as from a key medium written with
+// Client.WriteNodeKey.
+func createKeyDrive(key []byte, path string) error {
+	if err := createFATDrive(path, keyDriveLabel, config.NodeKeyFilename, key); err != nil {
+		return fmt.Errorf("failed to create key drive: %w", err)
+	}
+	return nil
+}
+
+// createFATDrive creates a FAT file system image with the label and a single file at its root.
+func createFATDrive(path, label, filename string, content []byte) error {
+	for _, tool := range []string{"mformat", "mcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%w. Please install mtools, e.g. using `brew install mtools` or `apt-get install mtools`",
+				err)
+		}
+	}
+	filePath := path + "." + filename
+	if err := os.WriteFile(filePath, content, 0600); err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.Remove(filePath)
+	if out, err := exec.Command("mformat", "-C", "-f", "1440", "-v", label, "-i", path,
+		"::").CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	if out, err := exec.Command("mcopy", "-o", "-i", path, filePath,
+		"::"+filename).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %s: %w: %s", filename, err, out)
+	}
+	return nil
+}
+
+// imageChunkSize is a size of the decompressed image chunks that are shared between the disk writers.
+const imageChunkSize = 4 << 20
+
+// installImages installs a raw disk image from the local file system on multiple block devices concurrently.
+// The image file must be compressed with xz. It's decompressed only once and the decompressed data is shared between
+// the disk writers. The returned slice contains a write error for each target. The returned error is only set
+// if the image can't be installed on any of the targets.
+func installImages(imagePath string, targets []imageTarget) ([]error, error) {
+	if err := checkImage(imagePath); err != nil {
+		return nil, err
+	}
+	useSudo := false
+	for _, t := range targets {
+		sudo, err := prepareDisk(t.device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare disk %s: %w", t.device, err)
+		}
+		useSudo = useSudo || sudo
+	}
+	if useSudo {
+		// Cache the sudo credentials once so that the concurrent writers don't prompt for the password.
+		fmt.Println("Using sudo to write to the disk devices. Please enter your user password if prompted.")
+		cmd := exec.Command("sudo", "-v")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to obtain sudo privileges: %w", err)
+		}
+	}
+
+	xz := exec.Command("xz", "--decompress", "--stdout", imagePath)
+	xzOut, err := xz.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var xzErr bytes.Buffer
+	xz.Stderr = &xzErr
+
+	writers := make([]*diskWriter, len(targets))
+	for i, t := range targets {
+		writers[i] = newDiskWriter(t.device, useSudo)
+	}
+	if err := xz.Start(); err != nil {
+		return nil, fmt.Errorf("failed to decompress image: %w", err)
+	}
+	var wg sync.WaitGroup
+	for _, w := range writers {
+		wg.Add(1)
+		go func(w *diskWriter) {
+			defer wg.Done()
+			w.run()
+		}(w)
+	}
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		reportProgress(writers, imageSize(imagePath), stopProgress)
+	}()
+
+	var readErr error
+	for {
+		// Allocate a new chunk for every read as the previous one can still be being written by the slower writers.
+		chunk := make([]byte, imageChunkSize)
+		n, err := io.ReadFull(xzOut, chunk)
+		if n > 0 {
+			for _, w := range writers {
+				w.chunks <- chunk[:n]
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	for _, w := range writers {
+		close(w.chunks)
+	}
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+	if err := xz.Wait(); err != nil && readErr == nil {
+		readErr = fmt.Errorf("%w: %s", err, strings.TrimSpace(xzErr.String()))
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to decompress image: %w", readErr)
+	}
+
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		if err := writers[i].err; err != nil {
+			errs[i] = fmt.Errorf("failed to write image to disk %s: %w", t.device, err)
+			continue
+		}
+		errs[i] = writeOSConfig(t.osCfg, t.device)
+	}
+	return errs, nil
+}
+
+// diskWriter writes chunks of a decompressed image to a disk device using dd.
+type diskWriter struct {
+	device  string
+	cmd     *exec.Cmd
+	chunks  chan []byte
+	written int64
+	err     error
+}
+
+func newDiskWriter(device string, useSudo bool) *diskWriter {
+	args := []string{"dd", "of=" + device, "bs=4194304"}
+	if useSudo {
+		args = append([]string{"sudo"}, args...)
+	}
+	return &diskWriter{
+		device: device,
+		cmd:    exec.Command(args[0], args[1:]...),
+		// Buffer a few chunks to smooth out the speed differences between the disks.
+		chunks: make(chan []byte, 4),
+	}
+}
+
+// run writes the received chunks to the disk until the chunks channel is closed. If writing fails, the remaining
+// chunks are discarded so that the other writers are not blocked.
+func (w *diskWriter) run() {
+	var stderr bytes.Buffer
+	w.cmd.Stderr = &stderr
+	stdin, err := w.cmd.StdinPipe()
+	if err == nil {
+		err = w.cmd.Start()
+	}
+	if err != nil {
+		w.err = err
+		for range w.chunks {
+		}
+		return
+	}
+	for chunk := range w.chunks {
+		if w.err != nil {
+			continue
+		}
+		if _, err := stdin.Write(chunk); err != nil {
+			w.err = err
+			continue
+		}
+		atomic.AddInt64(&w.written, int64(len(chunk)))
+	}
+	_ = stdin.Close()
+	if err := w.cmd.Wait(); err != nil && w.err == nil {
+		w.err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+}
+
+// reportProgress periodically prints how much of the image has been written to each disk until stop is closed.
+func reportProgress(writers []*diskWriter, total int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		progress := make([]string, len(writers))
+		for i, w := range writers {
+			written := atomic.LoadInt64(&w.written)
+			p := fmt.Sprintf("%s: %d MiB", w.device, written>>20)
+			if total > 0 {
+				p += fmt.Sprintf(" (%d%%)", written*100/total)
+			}
+			progress[i] = p
+		}
+		fmt.Println(strings.Join(progress, ", "))
+	}
+}
+
+// imageSize returns the uncompressed size of the xz compressed image or 0 if it's unknown.
+func imageSize(imagePath string) int64 {
+	out, err := exec.Command("xz", "--robot", "--list", imagePath).Output()
+	if err != nil {
+		return 0
+	}
+	// See the "Robot mode" section in the xz manual for the output format.
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) > 4 && fields[0] == "totals" {
+			size, err := strconv.ParseInt(fields[4], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return size
+		}
+	}
+	return 0
+}
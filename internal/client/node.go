@@ -1,29 +1,36 @@
 package client
 
 import (
+	"encoding/hex"
 	"fmt"
+	"github.com/psviderski/homecloud/pkg/crypt"
 	"github.com/psviderski/homecloud/pkg/os/config"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
+	"net"
+	"sort"
 	"strings"
-	"syscall"
-	"time"
 )
 
 const (
-	RPi4Provider = "rpi4"
 	// OSConfigFilename is a cloud-config file name on the node file system.
-	// Keep the name in sync with the one defined in /overlay/rpi4/system/oem/03_setup_config.yaml.
+	// Keep the name in sync with the one defined in /overlay/common/system/oem/03_setup_config.yaml.
 	OSConfigFilename = "hcos.yaml"
 )
 
 type Node struct {
-	Name        string        `json:"name"`
-	ClusterName string        `json:"clusterName"`
-	Provider    string        `json:"provider"`
-	OSConfig    config.Config `json:"-"`
+	Name        string `json:"name"`
+	ClusterName string `json:"clusterName"`
+	Provider    string `json:"provider"`
+	// Serial is a serial number of the board (last 8 hex digits for Raspberry Pi) that identifies the node
+	// when it boots over the network.
+	Serial string `json:"serial,omitempty"`
+	// MAC is a MAC address of the node network interface that identifies the node when it boots over the network.
+	MAC string `json:"mac,omitempty"`
+	// Options are provider specific settings of the node recorded by the provider when the node is provisioned.
+	Options  map[string]string `json:"options,omitempty"`
+	OSConfig config.Config     `json:"-"`
+	// SecretKey is the node key that the secrets in the OS config are sealed to when the config is written to
+	// the node disk. It's stored separately from the node metadata and installed on the node with PushNodeKey.
+	SecretKey []byte `json:"-"`
 }
 
 func (n *Node) Role() config.K3sRole {
@@ -39,13 +46,114 @@ type NodeRequest struct {
 	Name             string
 	ClusterName      string
 	ControlPlane     bool
-	WifiName         string
-	WifiPassword     string
+	Wifi             []config.WifiConfig
+	TailscaleAuthKey string
+	// Password is a plain text password for the hc user of the node. Only its hash is stored in the OS config.
+	Password string
+	// Options are provider specific options described by ProviderInfo.Options.
+	Options map[string]string
+}
+
+// ReconfigureRequest describes changes to the OS config of an existing node. Empty fields are left unchanged.
+type ReconfigureRequest struct {
+	Name        string
+	ClusterName string
+	// Wifi replaces the Wi-Fi networks of the node if not empty.
+	Wifi             []config.WifiConfig
+	RemoveWifi       bool
 	TailscaleAuthKey string
-	Image            string
 	InstallDevice    string
 }
 
+// ParseWifiNetworks parses colon separated Wi-Fi network names and passwords, e.g. "my-wifi:password". The networks
+// are prioritised in the order they are specified.
+func ParseWifiNetworks(values []string) []config.WifiConfig {
+	networks := make([]config.WifiConfig, len(values))
+	for i, v := range values {
+		networks[i].Name, networks[i].Password, _ = strings.Cut(v, ":")
+		networks[i].Priority = len(values) - i
+	}
+	return networks
+}
+
+// deriveWifiPSKs returns the networks with the passphrases of psk networks replaced by the derived pre-shared keys.
+func deriveWifiPSKs(networks []config.WifiConfig) []config.WifiConfig {
+	if networks == nil {
+		return nil
+	}
+	derived := make([]config.WifiConfig, len(networks))
+	for i, n := range networks {
+		derived[i] = n.WithDerivedPSK()
+	}
+	return derived
+}
+
+// GetNodeByBootID returns the node in the cluster identified by its serial number or MAC address. Nodes without
+// a serial number or MAC address never match.
+func (c *Client) GetNodeByBootID(clusterName, id string) (Node, error) {
+	serial, serialErr := NormalizeSerial(id)
+	mac, macErr := NormalizeMAC(id)
+	if serialErr != nil && macErr != nil {
+		return Node{}, &ErrNotFound{fmt.Sprintf("%q is neither a serial number nor a MAC address", id)}
+	}
+	nodes, err := c.ListNodes(clusterName)
+	if err != nil {
+		return Node{}, err
+	}
+	for _, n := range nodes {
+		if (serialErr == nil && n.Serial != "" && n.Serial == serial) ||
+			(macErr == nil && n.MAC != "" && n.MAC == mac) {
+			return n, nil
+		}
+	}
+	return Node{}, &ErrNotFound{fmt.Sprintf("node with serial number or MAC address %q not found in cluster %q",
+		id, clusterName)}
+}
+
+// NormalizeSerial converts a Raspberry Pi serial number to the 8 lowercase hex digits form used by the bootloader
+// when booting over the network. The full 16 digits serial number from /proc/cpuinfo is also accepted.
+func NormalizeSerial(serial string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(serial))
+	if s == "" {
+		return "", fmt.Errorf("serial number must not be empty")
+	}
+	if len(s) == 16 {
+		s = s[8:]
+	}
+	if _, err := hex.DecodeString(s); err != nil || len(s) != 8 {
+		return "", fmt.Errorf("invalid serial number %q, must be 8 or 16 hex digits", serial)
+	}
+	return s, nil
+}
+
+// NormalizeMAC converts a MAC address to the lowercase colon separated form.
+func NormalizeMAC(mac string) (string, error) {
+	if strings.TrimSpace(mac) == "" {
+		return "", fmt.Errorf("MAC address must not be empty")
+	}
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	return hw.String(), nil
+}
+
+// SealedOSConfig returns the OS config of the node as YAML with the secrets sealed to the node key. The key is
+// generated and saved to the store if the node doesn't have one yet.
+func (c *Client) SealedOSConfig(node Node) ([]byte, error) {
+	generated := node.SecretKey == nil
+	node, osCfg, err := sealNodeSecrets(node)
+	if err != nil {
+		return nil, err
+	}
+	if generated {
+		if err := c.Store.SaveNode(node.ClusterName, node); err != nil {
+			return nil, err
+		}
+	}
+	return osCfg.Marshal()
+}
+
 func (c *Client) GetNode(clusterName, name string) (Node, error) {
 	return c.Store.GetNode(clusterName, name)
 }
@@ -54,27 +162,138 @@ func (c *Client) ListNodes(clusterName string) ([]Node, error) {
 	return c.Store.ListNodes(clusterName)
 }
 
-func (c *Client) CreateRPi4Node(req NodeRequest) (Node, error) {
-	cluster, err := c.GetCluster(req.ClusterName)
+// CreateNode creates a new node for the cluster using the specified provider. The first node in the cluster becomes
+// a cluster-init node that the other nodes join.
+func (c *Client) CreateNode(providerName string, req NodeRequest) (Node, error) {
+	provider, err := GetProvider(providerName)
 	if err != nil {
 		return Node{}, err
 	}
-	if err := c.validateNodeName(cluster.Name, req.Name); err != nil {
+	if err := validateRequest(provider, req); err != nil {
+		return Node{}, err
+	}
+	cluster, node, err := c.prepareNode(provider, req)
+	if err != nil {
+		return Node{}, err
+	}
+	if node, err = provider.Provision(c.Store, node, req); err != nil {
+		return Node{}, err
+	}
+	if err := c.saveNewNode(&cluster, node); err != nil {
 		return Node{}, err
 	}
+	return node, nil
+}
 
-	sshKey, err := cluster.SSHAuthorizedKey()
+// RenderNode generates a new node with the OS config the same way as CreateNode does but without provisioning it.
+// The node is saved to the store if save is true so that the cluster roles assigned to the following nodes are
+// consistent with the rendered config, e.g. when the config is used to install the node manually.
+func (c *Client) RenderNode(providerName string, req NodeRequest, save bool) (Node, error) {
+	provider, err := GetProvider(providerName)
 	if err != nil {
 		return Node{}, err
 	}
-	k3sCfg := config.K3sConfig{
-		Token: cluster.Token,
+	if len(req.Wifi) > 0 && !provider.Describe().Wifi {
+		return Node{}, fmt.Errorf("%s provider doesn't support Wi-Fi", providerName)
+	}
+	cluster, node, err := c.prepareNode(provider, req)
+	if err != nil {
+		return Node{}, err
+	}
+	if save {
+		if err := c.saveNewNode(&cluster, node); err != nil {
+			return Node{}, err
+		}
+	}
+	return node, nil
+}
+
+// prepareNode generates a new node for the cluster assigning it the cluster-init role if it's the first node.
+func (c *Client) prepareNode(provider Provider, req NodeRequest) (Cluster, Node, error) {
+	cluster, err := c.GetCluster(req.ClusterName)
+	if err != nil {
+		return Cluster{}, Node{}, err
+	}
+	if err := c.validateNodeName(cluster.Name, req.Name); err != nil {
+		return Cluster{}, Node{}, err
 	}
 	nodes, err := c.ListNodes(cluster.Name)
+	if err != nil {
+		return Cluster{}, Node{}, err
+	}
+	node, err := newNode(provider, cluster, len(nodes) == 0, req)
+	if err != nil {
+		return Cluster{}, Node{}, err
+	}
+	return cluster, node, nil
+}
+
+// DeleteNode deprovisions the node using its provider and deletes it from the store. The cluster-init node can only
+// be deleted if it's the last node in the cluster as the other nodes use it as the cluster server.
+func (c *Client) DeleteNode(clusterName, name string) error {
+	cluster, err := c.GetCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	node, err := c.GetNode(cluster.Name, name)
+	if err != nil {
+		return err
+	}
+	nodes, err := c.ListNodes(cluster.Name)
+	if err != nil {
+		return err
+	}
+	if node.Role() == config.ClusterInitRole && len(nodes) > 1 {
+		return fmt.Errorf("cluster-init node %q can't be deleted while the cluster has other nodes", node.Name)
+	}
+	provider, err := GetProvider(node.Provider)
+	if err != nil {
+		return err
+	}
+	if err := provider.Deprovision(c.Store, node); err != nil {
+		return fmt.Errorf("failed to deprovision node %q: %w", node.Name, err)
+	}
+	if err := c.Store.DeleteNode(cluster.Name, node.Name); err != nil {
+		return err
+	}
+	if node.Role() == config.ClusterInitRole {
+		cluster.Server = ""
+		return c.Store.SaveCluster(cluster)
+	}
+	return nil
+}
+
+// validateRequest checks that all the options required by the provider are specified and the request is valid
+// for the provider.
+func validateRequest(provider Provider, req NodeRequest) error {
+	info := provider.Describe()
+	var missing []string
+	for _, opt := range info.Options {
+		if opt.Required && req.Options[opt.Name] == "" {
+			missing = append(missing, opt.Name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%s provider requires options: %s", info.Name, strings.Join(missing, ", "))
+	}
+	if len(req.Wifi) > 0 && !info.Wifi {
+		return fmt.Errorf("%s provider doesn't support Wi-Fi", info.Name)
+	}
+	return provider.ValidateRequest(req)
+}
+
+// newNode generates a new node with the validated OS config for the cluster rendered by the provider. The node becomes
+// a cluster-init node if first is true.
+func newNode(provider Provider, cluster Cluster, first bool, req NodeRequest) (Node, error) {
+	sshKey, err := cluster.SSHAuthorizedKey()
 	if err != nil {
 		return Node{}, err
 	}
-	if len(nodes) == 0 {
+	k3sCfg := config.K3sConfig{
+		Token: cluster.Token,
+	}
+	if first {
 		if !req.ControlPlane {
 			return Node{}, fmt.Errorf("the first node in the cluster must be a control plane node " +
 				"(--control-plane) that must be started before the other nodes")
@@ -89,6 +308,7 @@ func (c *Client) CreateRPi4Node(req NodeRequest) (Node, error) {
 		k3sCfg.Server = cluster.Server
 	}
 	osCfg := config.Config{
+		Version:           config.CurrentVersion,
 		Hostname:          fmt.Sprintf("%s-%s", req.Name, cluster.Name),
 		SSHAuthorizedKeys: []string{sshKey},
 		Network: config.NetworkConfig{
@@ -98,129 +318,66 @@ func (c *Client) CreateRPi4Node(req NodeRequest) (Node, error) {
 		},
 		K3s: k3sCfg,
 	}
-	if req.WifiName != "" {
-		osCfg.Network.Wifi = config.WifiConfig{
-			Name:     req.WifiName,
-			Password: req.WifiPassword,
+	osCfg.Network.Wifi = deriveWifiPSKs(req.Wifi)
+	if req.Password != "" {
+		if osCfg.Password, err = crypt.SHA512(req.Password); err != nil {
+			return Node{}, fmt.Errorf("failed to hash password: %w", err)
 		}
 	}
-	node := Node{
-		Name:        req.Name,
-		ClusterName: req.ClusterName,
-		Provider:    RPi4Provider,
-		OSConfig:    osCfg,
-	}
-
-	// TODO: download the latest image from GitHub if not specified and save under .homecloud. Update --image flag.
-	// TODO: download the image by URL.
-	if err := installImage(req.Image, osCfg, req.InstallDevice); err != nil {
+	if osCfg, err = provider.RenderOSConfig(osCfg, req); err != nil {
 		return Node{}, err
 	}
-	if err := c.Store.SaveNode(cluster.Name, node); err != nil {
+	if err := osCfg.Validate(); err != nil {
 		return Node{}, err
 	}
-	if node.Role() == config.ClusterInitRole {
-		cluster.Server = fmt.Sprintf("https://%s:6443", node.Host())
-		if err := c.Store.SaveCluster(cluster); err != nil {
-			return Node{}, err
-		}
-	}
-	return node, nil
-}
-
-func (c *Client) validateNodeName(clusterName, name string) error {
-	if _, err := c.GetNode(clusterName, name); err == nil {
-		return fmt.Errorf("node name %q is already in use in cluster %q", name, clusterName)
-	} else if _, ok := err.(*ErrNotFound); !ok {
-		return err
-	}
-	return nil
+	return Node{
+		Name:        req.Name,
+		ClusterName: cluster.Name,
+		Provider:    provider.Describe().Name,
+		OSConfig:    osCfg,
+	}, nil
 }
 
-// installImage installs a raw disk image from the local file system on the specified block device.
-// The image file must be compressed with xz.
-func installImage(imagePath string, osCfg config.Config, device string) error {
-	if _, err := os.Stat(imagePath); err != nil {
-		return err
-	}
-	if !strings.HasSuffix(imagePath, ".xz") {
-		// TODO: support uncompressed images.
-		return fmt.Errorf("image file must be compressed with xz")
-	}
-	if _, err := exec.LookPath("xz"); err != nil {
-		return fmt.Errorf("%w. Please install xz utils, e.g. using `brew install xz` or `apt-get install xz-utils`",
-			err)
-	}
-
-	// TODO: retrieve information about the disk and ask for user confirmation if it is correct.
-	// Unmount all device partitions if any of them are mounted.
-	mounts, err := exec.Command("mount").CombinedOutput()
-	if err != nil {
+// saveNewNode saves the created node and sets the cluster server if the node is a cluster-init node.
+func (c *Client) saveNewNode(cluster *Cluster, node Node) error {
+	if err := c.Store.SaveNode(cluster.Name, node); err != nil {
 		return err
 	}
-	if strings.Contains(string(mounts), device) {
-		if err := unmountDisk(device); err != nil {
+	if node.Role() == config.ClusterInitRole {
+		cluster.Server = clusterServer(node)
+		if err := c.Store.SaveCluster(*cluster); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	useSudo := false
-	if f, err := os.OpenFile(device, syscall.O_WRONLY, 0600); err == nil {
-		_ = f.Close()
-	} else if os.IsPermission(err) {
-		useSudo = true
-	} else {
-		return err
-	}
-	xzCmd := fmt.Sprintf("xz --decompress --stdout %q", imagePath)
-	ddCmd := fmt.Sprintf("dd of=%q status=progress", device)
-	if useSudo {
-		ddCmd = "sudo " + ddCmd
-		fmt.Println("Using sudo to write to the disk device. Please enter your user password if prompted.")
-	}
-	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("%s | %s", xzCmd, ddCmd))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("failed to write image to disk %s: %w", device, err)
-	}
-	// The first partition on a RPi4 disk is a FAT32 boot partition that is automatically mounted after writing
-	// the image. Note, it takes a moment to automount. See build_image_rpi4.sh for details on image layout.
-	path := ""
-	for start := time.Now(); time.Since(start) < 5 * time.Second; {
-		path, err = getPartitionMountPath(device + "s1")
+// sealNodeSecrets generates a node key if the node doesn't have one and returns the node with the key and its OS
+// config with the secrets sealed to the key so that the config can be written to the node disk without exposing them.
+func sealNodeSecrets(node Node) (Node, config.Config, error) {
+	if node.SecretKey == nil {
+		key, err := config.GenerateNodeKey()
 		if err != nil {
-			time.Sleep(time.Second)
-		} else {
-			break
+			return Node{}, config.Config{}, fmt.Errorf("failed to generate node key: %w", err)
 		}
+		node.SecretKey = key
 	}
+	osCfg, err := node.OSConfig.SealSecrets(node.SecretKey)
 	if err != nil {
-		return err
-	}
-	if err := osCfg.Write(filepath.Join(path, OSConfigFilename), 0600); err != nil {
-		return err
+		return Node{}, config.Config{}, fmt.Errorf("failed to seal secrets in OS config: %w", err)
 	}
-	return unmountDisk(device)
+	return node, osCfg, nil
 }
 
-func getPartitionMountPath(device string) (string, error) {
-	diskInfo, err := exec.Command("diskutil", "info", device).CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("failed to get info for disk partition %s: %w", device, err)
-	}
-	r := regexp.MustCompile(`Mount Point:\s+(.+)`)
-	match := r.FindStringSubmatch(string(diskInfo))
-	if match == nil {
-		return "", fmt.Errorf("disk partition %s is not mounted", device)
-	}
-	return match[1], nil
+func clusterServer(node Node) string {
+	return fmt.Sprintf("https://%s:6443", node.Host())
 }
 
-func unmountDisk(device string) error {
-	cmd := exec.Command("diskutil", "unmountDisk", device)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func (c *Client) validateNodeName(clusterName, name string) error {
+	if _, err := c.GetNode(clusterName, name); err == nil {
+		return fmt.Errorf("node name %q is already in use in cluster %q", name, clusterName)
+	} else if _, ok := err.(*ErrNotFound); !ok {
+		return err
+	}
+	return nil
 }
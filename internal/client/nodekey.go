@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"path"
+	"strings"
+)
+
+// PushKeyRequest describes a running HCOS node to install the node key on.
+type PushKeyRequest struct {
+	Name        string
+	ClusterName string
+	// Host is a host to connect to over SSH in the [user@]host[:port] format. The default user is hc and the default
+	// host is the node hostname.
+	Host string
+	// SSHKey is a path to the SSH private key to connect to the host with. The cluster SSH key is used by default.
+	SSHKey string
+	// Rotate generates a new node key and installs it along with the OS config with the secrets sealed to the new key.
+	Rotate bool
+}
+
+// nodeFile is a file to install on a node.
+type nodeFile struct {
+	path    string
+	content []byte
+}
+
+// PushNodeKey installs the node key that unseals the secrets in the OS config on a running node over SSH. The key is
+// never written to the node disk along with the config so that the secrets aren't exposed to anyone with access to
+// the disk. The agent waits for the key on the first boot before applying the parts of the config that need it.
+func (c *Client) PushNodeKey(req PushKeyRequest) (Node, error) {
+	node, err := c.GetNode(req.ClusterName, req.Name)
+	if err != nil {
+		return Node{}, err
+	}
+	if node.Provider == SSHProvider {
+		return Node{}, fmt.Errorf("node %q is not an HCOS node, only HCOS nodes have a node key", node.Name)
+	}
+	if node.SecretKey == nil && !req.Rotate {
+		return Node{}, fmt.Errorf("node %q doesn't have a node key, use rotate to generate one", node.Name)
+	}
+	host := req.Host
+	if host == "" {
+		host = node.Host()
+	}
+	if !strings.Contains(host, "@") {
+		host = defaultLoginUsername + "@" + host
+	}
+
+	var sealedCfg []byte
+	if req.Rotate {
+		node.SecretKey = nil
+		var osCfg config.Config
+		if node, osCfg, err = sealNodeSecrets(node); err != nil {
+			return Node{}, err
+		}
+		if sealedCfg, err = osCfg.Marshal(); err != nil {
+			return Node{}, err
+		}
+	}
+
+	client, err := dialNode(c.Store, node.ClusterName, host, req.SSHKey)
+	if err != nil {
+		return Node{}, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer client.Close()
+	sudo := sudoPrefix(host)
+
+	files := []nodeFile{{config.DefaultNodeKeyPath, node.SecretKey}}
+	if sealedCfg != nil {
+		files = append(files, nodeFile{config.DefaultConfigPath, sealedCfg})
+	}
+	// The files are uploaded next to the target ones first and then renamed together so that the node is not left
+	// with a config sealed to a key it doesn't have if the upload fails.
+	var rename []string
+	for _, f := range files {
+		if _, err := client.Run(fmt.Sprintf("%[1]smkdir -p %[2]s && %[1]ssh -c 'umask 077 && cat > %[3]s.new'",
+			sudo, path.Dir(f.path), f.path), bytes.NewReader(f.content)); err != nil {
+			return Node{}, fmt.Errorf("failed to upload %s: %w", f.path, err)
+		}
+		rename = append(rename, fmt.Sprintf("mv %[1]s.new %[1]s", f.path))
+	}
+	// The rotated key is saved before it's installed as the secrets can't be unsealed if the key is lost. Rotating
+	// the key again fixes the node if installing fails.
+	if req.Rotate {
+		if err := c.Store.SaveNode(node.ClusterName, node); err != nil {
+			return Node{}, err
+		}
+	}
+	if _, err := client.Run(fmt.Sprintf("%ssh -c '%s'", sudo, strings.Join(rename, " && ")), nil); err != nil {
+		return Node{}, fmt.Errorf("failed to install node key: %w", err)
+	}
+	return node, nil
+}
+
+// WriteKeyRequest describes a removable medium to write the node key of an HCOS node to.
+type WriteKeyRequest struct {
+	Name        string
+	ClusterName string
+	// Device is a disk device of the medium, e.g. /dev/disk4.
+	Device string
+	// Format erases the medium and creates a FAT32 partition labelled HCOS_KEY on it.
+	Format bool
+}
+
+// WriteNodeKey writes the node key that unseals the secrets in the OS config to a removable medium labelled HCOS_KEY.
+// The OS moves the key from the medium to its persistent partition when the medium is attached to the node, so it's
+// the only way to install the key on a node that can't be reached over SSH before the secrets are unsealed, e.g.
+// a node that connects to the network over Wi-Fi only.
+func (c *Client) WriteNodeKey(req WriteKeyRequest) (Node, error) {
+	node, err := c.GetNode(req.ClusterName, req.Name)
+	if err != nil {
+		return Node{}, err
+	}
+	if node.SecretKey == nil {
+		return Node{}, fmt.Errorf("node %q doesn't have a node key", node.Name)
+	}
+	if err := writeKeyMedium(node.SecretKey, req.Device, req.Format); err != nil {
+		return Node{}, err
+	}
+	return node, nil
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"sort"
+)
+
+// Provider provisions nodes of a particular kind, for example, Raspberry Pi 4 boards or virtual machines.
+// The cluster role election and storing nodes are handled by the client so providers only deal with
+// the provider specifics.
+type Provider interface {
+	// Describe returns information about the provider and the options it supports.
+	Describe() ProviderInfo
+	// ValidateRequest checks that the request is valid for the provider. The required options are checked
+	// by the client before calling it.
+	ValidateRequest(req NodeRequest) error
+	// RenderOSConfig adjusts the OS config generated for a new node to the provider specifics.
+	RenderOSConfig(cfg config.Config, req NodeRequest) (config.Config, error)
+	// Provision provisions the node with the OS config and returns the node updated with the provider specific
+	// options if any.
+	Provision(s *Store, node Node, req NodeRequest) (Node, error)
+	// Deprovision releases the resources allocated for the node by the provider.
+	Deprovision(s *Store, node Node) error
+}
+
+// ProviderInfo describes a provider and the options it supports.
+type ProviderInfo struct {
+	// Name is a unique name of the provider that is recorded in Node.Provider.
+	Name string
+	// Title is a human-readable name of the kind of nodes the provider provisions, e.g. "Raspberry Pi 4".
+	Title string
+	// Wifi indicates whether the provisioned nodes can connect to a Wi-Fi network.
+	Wifi    bool
+	Options []ProviderOption
+}
+
+// ProviderOption describes a provider specific option of a node request.
+type ProviderOption struct {
+	Name     string
+	Usage    string
+	Required bool
+}
+
+var providers = map[string]Provider{}
+
+// RegisterProvider makes the provider available by its name. It panics if a provider with the same name
+// is already registered.
+func RegisterProvider(p Provider) {
+	name := p.Describe().Name
+	if _, ok := providers[name]; ok {
+		panic(fmt.Sprintf("provider %q is already registered", name))
+	}
+	providers[name] = p
+}
+
+func GetProvider(name string) (Provider, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, &ErrNotFound{fmt.Sprintf("provider %q not found", name)}
+	}
+	return p, nil
+}
+
+// Providers returns all registered providers sorted by name.
+func Providers() []Provider {
+	ps := make([]Provider, 0, len(providers))
+	for _, p := range providers {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Describe().Name < ps[j].Describe().Name
+	})
+	return ps
+}
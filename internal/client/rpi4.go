@@ -0,0 +1,263 @@
+package client
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+)
+
+const (
+	RPi4Provider = "rpi4"
+
+	// ImageOption is a path to the Home Cloud OS image to install on the node disk.
+	ImageOption = "image"
+	// DiskOption is a disk device to install the node OS on.
+	DiskOption = "disk"
+	// SerialOption is a serial number of the Raspberry Pi board used to identify the node when it boots
+	// over the network.
+	SerialOption = "serial"
+	// MACOption is a MAC address of the node network interface used to identify the node when it boots
+	// over the network.
+	MACOption = "mac"
+)
+
+func init() {
+	RegisterProvider(rpi4Provider{})
+}
+
+// rpi4Provider provisions Raspberry Pi 4 nodes by installing the HCOS image on their disks (e.g. SD cards) with
+// the OS config written to the boot partition. Diskless nodes that boot over the network are only recorded with
+// their serial number or MAC address so that the netboot server can serve their OS config.
+type rpi4Provider struct{}
+
+func (rpi4Provider) Describe() ProviderInfo {
+	return ProviderInfo{
+		Name:  RPi4Provider,
+		Title: "Raspberry Pi 4",
+		Wifi:  true,
+		Options: []ProviderOption{
+			{
+				Name:  ImageOption,
+				Usage: "Path to the Home Cloud OS image to use for the node (required with --disk)",
+			},
+			{
+				Name: DiskOption,
+				Usage: "Disk device to partition and install the node OS on (e.g. /dev/disk4 or /dev/sdb). " +
+					"Please use with caution as all data on the device will be destroyed!",
+			},
+			{
+				Name:  SerialOption,
+				Usage: "Serial number of the board to identify the node booting over the network (see hc netboot)",
+			},
+			{
+				Name:  MACOption,
+				Usage: "MAC address of the node to identify it when booting over the network (see hc netboot)",
+			},
+		},
+	}
+}
+
+func (rpi4Provider) ValidateRequest(req NodeRequest) error {
+	if req.Options[DiskOption] == "" {
+		if req.Options[SerialOption] == "" && req.Options[MACOption] == "" {
+			return fmt.Errorf("%s option is required unless the node boots over the network (%s or %s option)",
+				DiskOption, SerialOption, MACOption)
+		}
+	} else if req.Options[ImageOption] == "" {
+		return fmt.Errorf("%s option is required to install the node OS on the disk", ImageOption)
+	}
+	if serial := req.Options[SerialOption]; serial != "" {
+		if _, err := NormalizeSerial(serial); err != nil {
+			return err
+		}
+	}
+	if mac := req.Options[MACOption]; mac != "" {
+		if _, err := NormalizeMAC(mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rpi4Provider) RenderOSConfig(cfg config.Config, _ NodeRequest) (config.Config, error) {
+	return cfg, nil
+}
+
+func (rpi4Provider) Provision(_ *Store, node Node, req NodeRequest) (Node, error) {
+	// Errors are checked in ValidateRequest. Options that are not set result in empty values.
+	node.Serial, _ = NormalizeSerial(req.Options[SerialOption])
+	node.MAC, _ = NormalizeMAC(req.Options[MACOption])
+	if req.Options[DiskOption] == "" {
+		return node, nil
+	}
+	// TODO: download the latest image from GitHub if not specified and save under .homecloud. Update --image flag.
+	// TODO: download the image by URL.
+	node, osCfg, err := sealNodeSecrets(node)
+	if err != nil {
+		return Node{}, err
+	}
+	if err := installImage(req.Options[ImageOption], osCfg, req.Options[DiskOption]); err != nil {
+		return Node{}, err
+	}
+	return node, nil
+}
+
+// Deprovision does nothing as the node disk is not accessible remotely. It should be wiped manually if needed.
+func (rpi4Provider) Deprovision(*Store, Node) error {
+	return nil
+}
+
+// NodeResult is a result of creating one of the nodes in a batch.
+type NodeResult struct {
+	Node   Node
+	Device string
+	Err    error
+}
+
+// CreateRPi4Nodes creates multiple Raspberry Pi 4 nodes in the same cluster at once installing the same image on their
+// disks concurrently. The nodes are assigned cluster roles in the order they are specified so if the cluster doesn't
+// have nodes yet, the first one must be a control plane node. The returned error is only set if none of the nodes
+// can be created, otherwise errors for the individual nodes are reported in the results.
+func (c *Client) CreateRPi4Nodes(reqs []NodeRequest) ([]NodeResult, error) {
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("at least one node must be specified")
+	}
+	provider, err := GetProvider(RPi4Provider)
+	if err != nil {
+		return nil, err
+	}
+	clusterName, image := reqs[0].ClusterName, reqs[0].Options[ImageOption]
+	names := map[string]bool{}
+	devices := map[string]bool{}
+	for _, req := range reqs {
+		if err := validateRequest(provider, req); err != nil {
+			return nil, fmt.Errorf("node %q: %w", req.Name, err)
+		}
+		if req.ClusterName != clusterName || req.Options[ImageOption] != image {
+			return nil, fmt.Errorf("all nodes must be created in the same cluster from the same image")
+		}
+		if names[req.Name] {
+			return nil, fmt.Errorf("node name %q is specified more than once", req.Name)
+		}
+		disk := req.Options[DiskOption]
+		if devices[disk] {
+			return nil, fmt.Errorf("disk %s is specified for more than one node", disk)
+		}
+		names[req.Name] = true
+		devices[disk] = true
+	}
+	cluster, err := c.GetCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := c.ListNodes(cluster.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate configs for all nodes before writing any of the disks. The server of the cluster is known as soon as
+	// the cluster-init node config is generated so the following nodes can join it.
+	results := make([]NodeResult, len(reqs))
+	targets := make([]imageTarget, len(reqs))
+	clusterInit := -1
+	for i, req := range reqs {
+		if err := c.validateNodeName(cluster.Name, req.Name); err != nil {
+			return nil, err
+		}
+		node, err := newNode(provider, cluster, len(nodes) == 0 && i == 0, req)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", req.Name, err)
+		}
+		if node.Role() == config.ClusterInitRole {
+			clusterInit = i
+			cluster.Server = clusterServer(node)
+		}
+		node, osCfg, err := sealNodeSecrets(node)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", req.Name, err)
+		}
+		results[i] = NodeResult{Node: node, Device: req.Options[DiskOption]}
+		targets[i] = imageTarget{device: req.Options[DiskOption], osCfg: osCfg}
+	}
+
+	errs, err := installImages(image, targets)
+	if err != nil {
+		return nil, err
+	}
+	if clusterInit >= 0 && errs[clusterInit] != nil {
+		// Other nodes can't be saved as the store would assign the cluster-init role to the next created node.
+		for i := range results {
+			results[i].Err = errs[i]
+			if results[i].Err == nil {
+				results[i].Err = fmt.Errorf("cluster-init node %q failed to be created",
+					results[clusterInit].Node.Name)
+			}
+		}
+		return results, nil
+	}
+	for i := range results {
+		results[i].Err = errs[i]
+		if results[i].Err == nil {
+			results[i].Err = c.saveNewNode(&cluster, results[i].Node)
+		}
+	}
+	return results, nil
+}
+
+// ReconfigureRPi4Node regenerates the OS config of an existing Raspberry Pi 4 node and writes it to the boot partition
+// of the disk with an already installed HCOS image without reinstalling the image.
+func (c *Client) ReconfigureRPi4Node(req ReconfigureRequest) (Node, error) {
+	cluster, err := c.GetCluster(req.ClusterName)
+	if err != nil {
+		return Node{}, err
+	}
+	node, err := c.GetNode(cluster.Name, req.Name)
+	if err != nil {
+		return Node{}, err
+	}
+	if node.Provider != RPi4Provider {
+		return Node{}, fmt.Errorf("node %q is not a Raspberry Pi 4 node (provider: %s)", node.Name, node.Provider)
+	}
+
+	// Refresh the cluster-wide settings as they could have changed since the node was created.
+	sshKey, err := cluster.SSHAuthorizedKey()
+	if err != nil {
+		return Node{}, err
+	}
+	osCfg := node.OSConfig
+	osCfg.SSHAuthorizedKeys = []string{sshKey}
+	osCfg.K3s.Token = cluster.Token
+	if node.Role() != config.ClusterInitRole && cluster.Server != "" {
+		osCfg.K3s.Server = cluster.Server
+	}
+	if req.RemoveWifi {
+		osCfg.Network.Wifi = nil
+	}
+	if len(req.Wifi) > 0 {
+		osCfg.Network.Wifi = req.Wifi
+	}
+	// Passphrases of the networks configured before the pre-shared keys were derived are replaced as well.
+	osCfg.Network.Wifi = deriveWifiPSKs(osCfg.Network.Wifi)
+	if req.TailscaleAuthKey != "" {
+		osCfg.Network.Tailscale.AuthKey = req.TailscaleAuthKey
+	}
+	if err := osCfg.Validate(); err != nil {
+		return Node{}, err
+	}
+	node.OSConfig = osCfg
+	node, sealedCfg, err := sealNodeSecrets(node)
+	if err != nil {
+		return Node{}, err
+	}
+
+	// The disk could have been unmounted after installing the image so make sure its partitions are mounted.
+	if err := mountDisk(req.InstallDevice); err != nil {
+		return Node{}, fmt.Errorf("failed to mount disk %s: %w", req.InstallDevice, err)
+	}
+	if err := writeOSConfig(sealedCfg, req.InstallDevice); err != nil {
+		return Node{}, err
+	}
+	if err := c.Store.SaveNode(cluster.Name, node); err != nil {
+		return Node{}, err
+	}
+	return node, nil
+}
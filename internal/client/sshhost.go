@@ -0,0 +1,198 @@
+package client
+
+import (
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/psviderski/homecloud/internal/k3s"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"github.com/psviderski/homecloud/pkg/ssh"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	SSHProvider = "ssh"
+
+	// HostOption is a remote host to connect to over SSH in the user@host[:port] format.
+	HostOption = "host"
+	// SSHKeyOption is a path to the SSH private key to connect to the host with.
+	SSHKeyOption = "ssh-key"
+
+	tailscaleInstallURL = "https://tailscale.com/install.sh"
+	k3sInstallURL       = "https://get.k3s.io"
+)
+
+func init() {
+	RegisterProvider(sshProvider{})
+}
+
+// sshProvider joins existing Linux hosts (e.g. running Debian or Ubuntu) to the cluster by installing Tailscale and
+// K3s over SSH. The remote user must be root or be allowed to run sudo without a password.
+type sshProvider struct{}
+
+func (sshProvider) Describe() ProviderInfo {
+	return ProviderInfo{
+		Name:  SSHProvider,
+		Title: "SSH-bootstrapped Linux",
+		Options: []ProviderOption{
+			{
+				Name:     HostOption,
+				Usage:    "Remote host to bootstrap over SSH in the user@host[:port] format",
+				Required: true,
+			},
+			{
+				Name:  SSHKeyOption,
+				Usage: "Path to the SSH private key to connect to the host with (default is the cluster SSH key)",
+			},
+		},
+	}
+}
+
+func (sshProvider) ValidateRequest(req NodeRequest) error {
+	_, _, err := parseSSHHost(req.Options[HostOption])
+	return err
+}
+
+func (sshProvider) RenderOSConfig(cfg config.Config, _ NodeRequest) (config.Config, error) {
+	return cfg, nil
+}
+
+func (sshProvider) Provision(s *Store, node Node, req NodeRequest) (Node, error) {
+	host := req.Options[HostOption]
+	client, err := dialNode(s, node.ClusterName, host, req.Options[SSHKeyOption])
+	if err != nil {
+		return Node{}, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer client.Close()
+	sudo := sudoPrefix(host)
+
+	fmt.Println("Installing Tailscale...")
+	if _, err := client.Run(fmt.Sprintf("command -v tailscale >/dev/null || curl -fsSL %s | %ssh",
+		tailscaleInstallURL, sudo), nil); err != nil {
+		return Node{}, fmt.Errorf("failed to install Tailscale: %w", err)
+	}
+	// The Tailscale machine name is used to reach the node in the tailnet, see Node.Host.
+	if _, err := client.Run(fmt.Sprintf("%stailscale up --auth-key %s --hostname %s --timeout 60s", sudo,
+		shellQuote(node.OSConfig.Network.Tailscale.AuthKey), shellQuote(node.OSConfig.Hostname)), nil); err != nil {
+		return Node{}, fmt.Errorf("unable to connect to Tailscale: %w", err)
+	}
+	out, err := client.Run(sudo+"tailscale ip -4", nil)
+	if err != nil {
+		return Node{}, fmt.Errorf("unable to get Tailscale IP: %w", err)
+	}
+	tsIP := strings.TrimSpace(out)
+	if net.ParseIP(tsIP) == nil {
+		return Node{}, fmt.Errorf("invalid Tailscale IP: %q", tsIP)
+	}
+
+	fmt.Println("Installing k3s...")
+	k3sCfg, cmd, err := k3s.NewConfig(node.OSConfig.K3s, tsIP, "")
+	if err != nil {
+		return Node{}, err
+	}
+	// The host name is not changed so the K3s node name is set explicitly to match the node hostname.
+	k3sCfg.NodeName = node.OSConfig.Hostname
+	k3sCfgYAML, err := yaml.Marshal(&k3sCfg)
+	if err != nil {
+		return Node{}, err
+	}
+	if _, err := client.Run(fmt.Sprintf("%[1]smkdir -p /etc/rancher/k3s && %[1]ssh -c 'umask 077 && cat > %[2]s'",
+		sudo, k3s.ConfigPath), strings.NewReader(string(k3sCfgYAML))); err != nil {
+		return Node{}, fmt.Errorf("failed to write k3s config %s: %w", k3s.ConfigPath, err)
+	}
+	if _, err := client.Run(fmt.Sprintf("curl -sfL %s | %sINSTALL_K3S_EXEC=%s sh -",
+		k3sInstallURL, sudoEnvPrefix(sudo), cmd), nil); err != nil {
+		return Node{}, fmt.Errorf("failed to install k3s: %w", err)
+	}
+
+	node.Options = map[string]string{HostOption: host}
+	if key := req.Options[SSHKeyOption]; key != "" {
+		node.Options[SSHKeyOption] = key
+	}
+	return node, nil
+}
+
+// Deprovision uninstalls K3s and logs out from Tailscale on the host.
+func (sshProvider) Deprovision(s *Store, node Node) error {
+	host := node.Options[HostOption]
+	client, err := dialNode(s, node.ClusterName, host, node.Options[SSHKeyOption])
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer client.Close()
+	sudo := sudoPrefix(host)
+	uninstall := "/usr/local/bin/k3s-uninstall.sh"
+	if node.Role() == config.WorkerRole {
+		uninstall = "/usr/local/bin/k3s-agent-uninstall.sh"
+	}
+	if _, err := client.Run(fmt.Sprintf("[ ! -x %[2]s ] || %[1]s%[2]s", sudo, uninstall), nil); err != nil {
+		return fmt.Errorf("failed to uninstall k3s: %w", err)
+	}
+	if _, err := client.Run(sudo+"tailscale logout", nil); err != nil {
+		return fmt.Errorf("failed to log out from Tailscale: %w", err)
+	}
+	return nil
+}
+
+// dialNode connects to the host using the SSH key from the path or the cluster SSH key if the path is empty.
+func dialNode(s *Store, clusterName, host, keyPath string) (*ssh.Client, error) {
+	user, addr, err := parseSSHHost(host)
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if keyPath != "" {
+		path, err := homedir.Expand(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find SSH private key: %w", err)
+		}
+		if key, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("cannot read SSH private key: %w", err)
+		}
+	} else {
+		cluster, err := s.GetCluster(clusterName)
+		if err != nil {
+			return nil, err
+		}
+		key = cluster.SSHKey
+	}
+	client, err := ssh.Dial(addr, user, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s over SSH: %w", host, err)
+	}
+	return client, nil
+}
+
+// parseSSHHost parses the host in the user@host[:port] format.
+func parseSSHHost(host string) (string, string, error) {
+	user, addr, ok := strings.Cut(host, "@")
+	if !ok || user == "" || addr == "" {
+		return "", "", fmt.Errorf("invalid host %q, must be in the user@host[:port] format", host)
+	}
+	return user, addr, nil
+}
+
+// sudoPrefix returns a prefix for running commands as root on the host unless connected as root.
+func sudoPrefix(host string) string {
+	if strings.HasPrefix(host, "root@") {
+		return ""
+	}
+	return "sudo -n "
+}
+
+// sudoEnvPrefix returns a prefix for running a command with environment variables as root.
+func sudoEnvPrefix(sudo string) string {
+	if sudo == "" {
+		return ""
+	}
+	return sudo + "env "
+}
+
+// shellQuote quotes the string to be safely used as a single argument in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -3,7 +3,7 @@ package client
 import (
 	"encoding/json"
 	"fmt"
-	"gopkg.in/yaml.v3"
+	"github.com/psviderski/homecloud/pkg/os/config"
 	"os"
 	"path/filepath"
 )
@@ -14,6 +14,7 @@ const (
 	sshKeyFileName   = "ssh_key"
 	nodeFileName     = "node.json"
 	osConfigFileName = "hcos.yaml"
+	nodeKeyFileName  = "hcos.key"
 )
 
 type ErrNotFound struct {
@@ -115,7 +116,10 @@ func (s *Store) GetNode(clusterName, name string) (Node, error) {
 	if err != nil {
 		return Node{}, err
 	}
-	if err := yaml.Unmarshal(osCfgData, &node.OSConfig); err != nil {
+	if node.OSConfig, err = config.ParseConfig(osCfgData, false); err != nil {
+		return Node{}, fmt.Errorf("unable to parse OS config of node %q: %w", name, err)
+	}
+	if node.SecretKey, err = os.ReadFile(filepath.Join(dir, nodeKeyFileName)); err != nil && !os.IsNotExist(err) {
 		return Node{}, err
 	}
 	return node, nil
@@ -154,7 +158,17 @@ func (s *Store) SaveNode(clusterName string, node Node) error {
 		return err
 	}
 	// OS config contains sensitive data, so we need to make sure it's not readable by other users.
-	return node.OSConfig.Write(filepath.Join(dir, osConfigFileName), 0600)
+	if err := node.OSConfig.Write(filepath.Join(dir, osConfigFileName), 0600); err != nil {
+		return err
+	}
+	if node.SecretKey == nil {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(dir, nodeKeyFileName), node.SecretKey, 0600)
+}
+
+func (s *Store) DeleteNode(clusterName, name string) error {
+	return os.RemoveAll(s.nodeDir(clusterName, name))
 }
 
 func (s *Store) nodeDir(clusterName, name string) string {
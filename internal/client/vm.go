@@ -0,0 +1,398 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	VMProvider = "vm"
+
+	// VMFormatOption is a format of the VM disk image: qcow2 or raw.
+	VMFormatOption = "format"
+	// VMDiskSizeOption is a size the VM disk image is resized to, e.g. 16G.
+	VMDiskSizeOption = "disk-size"
+	// VMArchOption is a CPU architecture of the VM: amd64 or arm64.
+	VMArchOption = "arch"
+	// VMMemoryOption is a memory size of the VM in MiB.
+	VMMemoryOption = "memory"
+	// VMCPUsOption is a number of virtual CPUs of the VM.
+	VMCPUsOption = "cpus"
+	// VMFirmwareOption is a path to the UEFI firmware to boot the VM with, e.g. QEMU_EFI.fd for arm64.
+	VMFirmwareOption = "firmware"
+
+	vmDir             = "vm"
+	vmDiskFileName    = "disk"
+	vmConfigDriveName = "config.img"
+	vmKeyDriveName    = "key.img"
+	vmPIDFileName     = "qemu.pid"
+	vmConsoleSocket   = "console.sock"
+	vmQMPSocket       = "qmp.sock"
+)
+
+func init() {
+	RegisterProvider(vmProvider{})
+}
+
+// vmProvider provisions local QEMU virtual machines for testing. The VM disk is created from the HCOS image and
+// the OS config is provided on a separate config drive that the OS picks up on boot the same way as from the boot
+// partition on real hardware. The node key that unseals the secrets in the config is provided on another drive
+// the same way as on a removable medium for real hardware.
+type vmProvider struct{}
+
+func (vmProvider) Describe() ProviderInfo {
+	return ProviderInfo{
+		Name:  VMProvider,
+		Title: "local QEMU virtual machine",
+		Options: []ProviderOption{
+			{
+				Name:     ImageOption,
+				Usage:    "Path to the Home Cloud OS image to create the VM disk from (.img or .img.xz)",
+				Required: true,
+			},
+			{
+				Name:  VMFormatOption,
+				Usage: "Format of the VM disk image: qcow2 or raw (default qcow2)",
+			},
+			{
+				Name:  VMDiskSizeOption,
+				Usage: "Size to resize the VM disk image to, e.g. 16G (default is the image size)",
+			},
+			{
+				Name:  VMArchOption,
+				Usage: "CPU architecture of the VM: amd64 or arm64 (default is the host architecture)",
+			},
+			{
+				Name:  VMMemoryOption,
+				Usage: "Memory size of the VM in MiB (default 2048)",
+			},
+			{
+				Name:  VMCPUsOption,
+				Usage: "Number of virtual CPUs of the VM (default 2)",
+			},
+			{
+				Name:  VMFirmwareOption,
+				Usage: "Path to the UEFI firmware to boot the VM with, e.g. QEMU_EFI.fd (required for arm64)",
+			},
+		},
+	}
+}
+
+func (vmProvider) ValidateRequest(req NodeRequest) error {
+	switch req.Options[VMFormatOption] {
+	case "", "qcow2", "raw":
+	default:
+		return fmt.Errorf("VM disk format must be one of: qcow2, raw")
+	}
+	arch := vmArch(req.Options)
+	switch arch {
+	case "amd64":
+	case "arm64":
+		if req.Options[VMFirmwareOption] == "" {
+			return fmt.Errorf("%s option is required for arm64 VMs", VMFirmwareOption)
+		}
+	default:
+		return fmt.Errorf("VM architecture must be one of: amd64, arm64")
+	}
+	for _, name := range []string{VMMemoryOption, VMCPUsOption} {
+		if v := req.Options[name]; v != "" {
+			if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+				return fmt.Errorf("%s option must be a positive number", name)
+			}
+		}
+	}
+	if _, err := exec.LookPath(qemuBinary(arch)); err != nil {
+		return fmt.Errorf("%w. Please install QEMU, e.g. using `brew install qemu` or `apt-get install qemu-system`",
+			err)
+	}
+	return nil
+}
+
+func (vmProvider) RenderOSConfig(cfg config.Config, _ NodeRequest) (config.Config, error) {
+	return cfg, nil
+}
+
+func (vmProvider) Provision(s *Store, node Node, req NodeRequest) (Node, error) {
+	dir := filepath.Join(s.nodeDir(node.ClusterName, node.Name), vmDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Node{}, err
+	}
+	vmNode, err := createVMFiles(dir, node, req.Options)
+	if err != nil {
+		// Do not leave a node directory without the node record in the store.
+		_ = s.DeleteNode(node.ClusterName, node.Name)
+		return Node{}, err
+	}
+	return vmNode, nil
+}
+
+func (vmProvider) Deprovision(s *Store, node Node) error {
+	if err := stopVM(s, node, true); err != nil && !errors.Is(err, errVMNotRunning) {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.nodeDir(node.ClusterName, node.Name), vmDir))
+}
+
+// createVMFiles creates the VM disk from the image, the config drive and the key drive in the directory and returns
+// the node with the node key and the options required to start the VM.
+func createVMFiles(dir string, node Node, reqOpts map[string]string) (Node, error) {
+	for _, tool := range []string{"qemu-img", "mformat", "mcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return Node{}, fmt.Errorf("%w. Please install QEMU and mtools, e.g. using `brew install qemu mtools` "+
+				"or `apt-get install qemu-utils mtools`", err)
+		}
+	}
+	format := reqOpts[VMFormatOption]
+	if format == "" {
+		format = "qcow2"
+	}
+	rawPath := filepath.Join(dir, vmDiskFileName+".raw")
+	if err := copyImage(reqOpts[ImageOption], rawPath); err != nil {
+		return Node{}, err
+	}
+	diskPath := rawPath
+	if format == "qcow2" {
+		diskPath = filepath.Join(dir, vmDiskFileName+".qcow2")
+		if out, err := exec.Command("qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawPath,
+			diskPath).CombinedOutput(); err != nil {
+			return Node{}, fmt.Errorf("failed to convert VM disk to qcow2: %w: %s", err, out)
+		}
+		if err := os.Remove(rawPath); err != nil {
+			return Node{}, err
+		}
+	}
+	if size := reqOpts[VMDiskSizeOption]; size != "" {
+		if out, err := exec.Command("qemu-img", "resize", "-f", format, diskPath, size).CombinedOutput(); err != nil {
+			return Node{}, fmt.Errorf("failed to resize VM disk: %w: %s", err, out)
+		}
+	}
+
+	node, err := createConfigDrive(node, filepath.Join(dir, vmConfigDriveName))
+	if err != nil {
+		return Node{}, err
+	}
+	if err := createKeyDrive(node.SecretKey, filepath.Join(dir, vmKeyDriveName)); err != nil {
+		return Node{}, err
+	}
+
+	opts := map[string]string{
+		VMFormatOption: format,
+		VMArchOption:   vmArch(reqOpts),
+		VMMemoryOption: "2048",
+		VMCPUsOption:   "2",
+	}
+	for _, name := range []string{VMMemoryOption, VMCPUsOption, VMFirmwareOption} {
+		if v := reqOpts[name]; v != "" {
+			opts[name] = v
+		}
+	}
+	node.Options = opts
+	return node, nil
+}
+
+var errVMNotRunning = errors.New("VM is not running")
+
+// StartVM starts the VM node in the background using QEMU. The VM console is available on a Unix socket
+// (see VMConsoleSocket).
+func (c *Client) StartVM(clusterName, name string) error {
+	node, dir, err := c.getVMNode(clusterName, name)
+	if err != nil {
+		return err
+	}
+	if _, err := vmPID(dir); err == nil {
+		return fmt.Errorf("VM %q is already running", name)
+	}
+	arch := node.Options[VMArchOption]
+	args := []string{
+		"-m", node.Options[VMMemoryOption],
+		"-smp", node.Options[VMCPUsOption],
+		"-drive", fmt.Sprintf("if=virtio,file=%s,format=%s",
+			filepath.Join(dir, vmDiskFileName+"."+node.Options[VMFormatOption]), node.Options[VMFormatOption]),
+		"-drive", fmt.Sprintf("if=virtio,file=%s,format=raw", filepath.Join(dir, vmConfigDriveName)),
+		"-nic", "user,model=virtio-net-pci",
+		"-display", "none",
+		"-serial", fmt.Sprintf("unix:%s,server=on,wait=off", filepath.Join(dir, vmConsoleSocket)),
+		"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", filepath.Join(dir, vmQMPSocket)),
+		"-pidfile", filepath.Join(dir, vmPIDFileName),
+		"-daemonize",
+	}
+	// VMs created before the secrets were sealed don't have a key drive.
+	keyDrive := filepath.Join(dir, vmKeyDriveName)
+	if _, err := os.Stat(keyDrive); err == nil {
+		args = append(args, "-drive", fmt.Sprintf("if=virtio,file=%s,format=raw", keyDrive))
+	}
+	if arch == "arm64" {
+		// Software emulation is used by default as hardware acceleration is only available on the same host arch.
+		args = append(args, "-machine", "virt", "-cpu", "cortex-a72")
+	} else {
+		args = append(args, "-machine", "q35")
+	}
+	if fw := node.Options[VMFirmwareOption]; fw != "" {
+		args = append(args, "-bios", fw)
+	}
+	cmd := exec.Command(qemuBinary(arch), args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to start VM %q: %w: %s", name, err, out)
+	}
+	return nil
+}
+
+// StopVM gracefully shuts down the VM node or kills it immediately if force is true.
+func (c *Client) StopVM(clusterName, name string, force bool) error {
+	node, _, err := c.getVMNode(clusterName, name)
+	if err != nil {
+		return err
+	}
+	return stopVM(c.Store, node, force)
+}
+
+// VMConsoleSocket returns the path to the Unix socket connected to the serial console of the running VM node.
+func (c *Client) VMConsoleSocket(clusterName, name string) (string, error) {
+	_, dir, err := c.getVMNode(clusterName, name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := vmPID(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, vmConsoleSocket), nil
+}
+
+func (c *Client) getVMNode(clusterName, name string) (Node, string, error) {
+	node, err := c.GetNode(clusterName, name)
+	if err != nil {
+		return Node{}, "", err
+	}
+	if node.Provider != VMProvider {
+		return Node{}, "", fmt.Errorf("node %q is not a VM node (provider: %s)", node.Name, node.Provider)
+	}
+	return node, filepath.Join(c.Store.nodeDir(clusterName, name), vmDir), nil
+}
+
+func stopVM(s *Store, node Node, force bool) error {
+	dir := filepath.Join(s.nodeDir(node.ClusterName, node.Name), vmDir)
+	pid, err := vmPID(dir)
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if !force {
+		if err := qmpExecute(filepath.Join(dir, vmQMPSocket), "system_powerdown"); err != nil {
+			return fmt.Errorf("failed to shut down VM %q: %w", node.Name, err)
+		}
+		for start := time.Now(); time.Since(start) < time.Minute; time.Sleep(time.Second) {
+			if _, err := vmPID(dir); err != nil {
+				return nil
+			}
+		}
+		fmt.Println("VM didn't shut down in time, killing it.")
+	}
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	// QEMU removes the PID file on exit but not when it's killed.
+	_ = os.Remove(filepath.Join(dir, vmPIDFileName))
+	return nil
+}
+
+// vmPID returns the PID of the running QEMU process for the VM or errVMNotRunning.
+func vmPID(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, vmPIDFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, errVMNotRunning
+		}
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid QEMU PID file: %w", err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, errVMNotRunning
+	}
+	// Signal 0 checks whether the process exists.
+	if err := proc.Signal(syscall.Signal(0)); err != nil {
+		return 0, errVMNotRunning
+	}
+	return pid, nil
+}
+
+// qmpExecute executes a QEMU Machine Protocol command without arguments using the QMP socket.
+// See https://wiki.qemu.org/Documentation/QMP
+func qmpExecute(socket, command string) error {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	// Read the greeting before negotiating the capabilities.
+	if _, err := r.ReadBytes('\n'); err != nil {
+		return err
+	}
+	for _, cmd := range []string{"qmp_capabilities", command} {
+		req, err := json.Marshal(map[string]string{"execute": cmd})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(req, '\n')); err != nil {
+			return err
+		}
+		// Skip asynchronous events until the command response is received.
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			var resp struct {
+				Return json.RawMessage `json:"return"`
+				Error  *struct {
+					Desc string `json:"desc"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(line, &resp); err != nil {
+				return err
+			}
+			if resp.Error != nil {
+				return fmt.Errorf("QMP command %s failed: %s", cmd, resp.Error.Desc)
+			}
+			if resp.Return != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func vmArch(opts map[string]string) string {
+	if arch := opts[VMArchOption]; arch != "" {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+func qemuBinary(arch string) string {
+	if arch == "arm64" {
+		return "qemu-system-aarch64"
+	}
+	return "qemu-system-x86_64"
+}
@@ -0,0 +1,165 @@
+// Package k3s generates K3s configuration for the node roles defined in the OS config. It's shared by the OS agent
+// and the providers that install K3s on existing hosts so that all nodes are configured the same way.
+package k3s
+
+import (
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"sort"
+	"strings"
+)
+
+const (
+	ConfigPath  = "/etc/rancher/k3s/config.yaml"
+	EnvFilePath = "/etc/rancher/k3s/k3s.env"
+
+	// TailscaleIface is a network interface of the Tailscale overlay network that is used for the cluster traffic.
+	TailscaleIface = "tailscale0"
+
+	ServerCommand = "server"
+	AgentCommand  = "agent"
+
+	// ClusterCIDR and ServiceCIDR are the default K3s networks for pod and service IPs.
+	ClusterCIDR = "10.42.0.0/16"
+	ServiceCIDR = "10.43.0.0/16"
+)
+
+// Config stores configuration parameters for K3s server or agent. It is intended to be serialized as YAML to a file
+// that is used by K3s to load configuration from (default: /etc/rancher/k3s/config.yaml). See for more details about
+// K3s configuration file: https://rancher.com/docs/k3s/latest/en/installation/install-options/#configuration-file
+// The names of the options must be listed in config.K3sManagedOptions so that they can't be overridden by Extra.
+type Config struct {
+	ClusterInit       bool     `yaml:"cluster-init,omitempty"`
+	Server            string   `yaml:"server,omitempty"`
+	Token             string   `yaml:"token"`
+	NodeName          string   `yaml:"node-name,omitempty"`
+	BindAddress       string   `yaml:"bind-address,omitempty"`
+	FlannelIface      string   `yaml:"flannel-iface"`
+	NodeLabels        []string `yaml:"node-label,omitempty"`
+	NodeTaints        []string `yaml:"node-taint,omitempty"`
+	Disable           []string `yaml:"disable,omitempty"`
+	KubeletArgs       []string `yaml:"kubelet-arg,omitempty"`
+	KubeAPIServerArgs []string `yaml:"kube-apiserver-arg,omitempty"`
+	NodeIP            []string `yaml:"node-ip,omitempty"`
+	NodeExternalIP    []string `yaml:"node-external-ip,omitempty"`
+	TLSSAN            []string `yaml:"tls-san,omitempty"`
+	// Extra contains other options that are passed through as is.
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// NewConfig generates the K3s configuration for the node role and returns it along with the K3s command (server or
+// agent) to run. tailscaleIP is the node IP address in the Tailscale overlay network that the control plane binds to.
+// tailscaleIP and tailscaleName (optional) are also added to the TLS certificate of the control plane.
+func NewConfig(cfg config.K3sConfig, tailscaleIP, tailscaleName string) (Config, string, error) {
+	if cfg.Token == "" {
+		return Config{}, "", fmt.Errorf("k3s token is required")
+	}
+	k3sCfg := Config{
+		Token:          cfg.Token,
+		FlannelIface:   TailscaleIface,
+		NodeTaints:     cfg.NodeTaints,
+		KubeletArgs:    cfg.KubeletArgs,
+		NodeIP:         cfg.NodeIP,
+		NodeExternalIP: cfg.NodeExternalIP,
+	}
+	cmd := ServerCommand
+	switch cfg.Role {
+	case config.ClusterInitRole:
+		k3sCfg.ClusterInit = true
+		k3sCfg.BindAddress = tailscaleIP
+	case config.ControlPlaneRole:
+		if cfg.Server == "" {
+			return Config{}, "", fmt.Errorf("k3s server to join is required")
+		}
+		k3sCfg.Server = cfg.Server
+		k3sCfg.BindAddress = tailscaleIP
+	case config.WorkerRole:
+		cmd = AgentCommand
+		if cfg.Server == "" {
+			return Config{}, "", fmt.Errorf("k3s server to join is required")
+		}
+		k3sCfg.Server = cfg.Server
+	default:
+		return Config{}, "", fmt.Errorf("k3s role is invalid, must be one of: %s, %s, %s",
+			config.ClusterInitRole, config.ControlPlaneRole, config.WorkerRole)
+	}
+
+	if cfg.Role.IsServer() {
+		k3sCfg.Disable = cfg.Disable
+		k3sCfg.KubeAPIServerArgs = cfg.KubeAPIServerArgs
+		for _, san := range append([]string{tailscaleIP, tailscaleName}, cfg.TLSSAN...) {
+			if san != "" && !contains(k3sCfg.TLSSAN, san) {
+				k3sCfg.TLSSAN = append(k3sCfg.TLSSAN, san)
+			}
+		}
+	} else {
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"disable", len(cfg.Disable) > 0},
+			{"kube-apiserver-arg", len(cfg.KubeAPIServerArgs) > 0},
+			{"tls-san", len(cfg.TLSSAN) > 0},
+		} {
+			if opt.set {
+				return Config{}, "", fmt.Errorf("k3s option %s is only supported for %s and %s roles", opt.name,
+					config.ClusterInitRole, config.ControlPlaneRole)
+			}
+		}
+	}
+
+	// Sort the labels to generate the same config for the same labels.
+	for key, value := range cfg.NodeLabels {
+		k3sCfg.NodeLabels = append(k3sCfg.NodeLabels, key+"="+value)
+	}
+	sort.Strings(k3sCfg.NodeLabels)
+
+	if len(cfg.Extra) > 0 {
+		k3sCfg.Extra = make(map[string]interface{}, len(cfg.Extra))
+		for name, value := range cfg.Extra {
+			if contains(config.K3sManagedOptions, name) {
+				return Config{}, "", fmt.Errorf("k3s option %s can't be set in extra options as it's managed "+
+					"by the OS config", name)
+			}
+			k3sCfg.Extra[name] = value
+		}
+	}
+	return k3sCfg, cmd, nil
+}
+
+// noProxyDefaults are the networks that must be accessed directly when a proxy is used: the loopback, the default
+// K3s cluster (pod) and service CIDRs, the cluster DNS domain, and the Tailscale CGNAT range the nodes talk over.
+var noProxyDefaults = []string{
+	"127.0.0.1", "localhost", ClusterCIDR, ServiceCIDR, ".svc", ".cluster.local", "100.64.0.0/10",
+}
+
+// ProxyEnv returns the proxy environment variables for K3s and its embedded containerd, and for other services
+// that need the proxy to access the internet, e.g. tailscaled. It returns nil if the proxy is not configured.
+func ProxyEnv(cfg config.ProxyConfig) []string {
+	if !cfg.Enabled() {
+		return nil
+	}
+	var env []string
+	if cfg.HTTP != "" {
+		env = append(env, "HTTP_PROXY="+cfg.HTTP)
+	}
+	if cfg.HTTPS != "" {
+		env = append(env, "HTTPS_PROXY="+cfg.HTTPS)
+	}
+	noProxy := append([]string{}, noProxyDefaults...)
+	for _, host := range cfg.NoProxy {
+		if !contains(noProxy, host) {
+			noProxy = append(noProxy, host)
+		}
+	}
+	return append(env, "NO_PROXY="+strings.Join(noProxy, ","))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Package netboot implements TFTP and HTTP servers for booting Raspberry Pi nodes over the network. The servers serve
+// the boot files, the HCOS image, and the personal OS config of every node identified by its serial number or
+// MAC address.
+package netboot
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigFilename is a name of the node OS config file served by the servers.
+const ConfigFilename = "hcos.yaml"
+
+// ConfigFunc returns the OS config of the node identified by its serial number or MAC address. It must return
+// an error that wraps fs.ErrNotExist if the node is unknown.
+type ConfigFunc func(id string) ([]byte, error)
+
+type Server struct {
+	// BootDir is a directory with the Raspberry Pi boot files (the content of the HCOS_BOOT partition).
+	BootDir string
+	// Image is a path to the HCOS image file served over HTTP.
+	Image  string
+	Config ConfigFunc
+}
+
+// HTTPHandler returns an HTTP handler that serves:
+//   - /boot/PATH: the boot files from the boot directory.
+//   - /image: the HCOS image file.
+//   - /config/ID: the OS config of the node identified by its serial number or MAC address.
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/boot/", http.StripPrefix("/boot/", http.FileServer(http.Dir(s.BootDir))))
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		if s.Image == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, s.Image)
+	})
+	mux.HandleFunc("/config/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/config/")
+		if !isBootID(id) {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := s.Config(id)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Printf("HTTP: failed to get config for node %q: %v\n", id, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("HTTP: serving config for node %q to %s\n", id, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(data)
+	})
+	return mux
+}
+
+// open opens a file requested over TFTP. The Raspberry Pi bootloader requests files prefixed with the board serial
+// number, e.g. 1a2b3c4d/start4.elf. SERIAL/hcos.yaml returns the node OS config and other files are served from
+// the boot directory regardless of the serial number prefix.
+func (s *Server) open(name string) (fileReader, error) {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))[1:]
+	dir, file := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	if file == ConfigFilename && dir != "" && !strings.Contains(dir, "/") {
+		if !isSerial(dir) {
+			return nil, fs.ErrNotExist
+		}
+		data, err := s.Config(dir)
+		if err != nil {
+			return nil, err
+		}
+		return newBytesFile(data), nil
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok && isSerial(first) {
+		name = rest
+	}
+	f, err := os.Open(filepath.Join(s.BootDir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
+
+// isBootID checks that the node ID is a serial number (8 or 16 hex digits) or a MAC address.
+func isBootID(id string) bool {
+	s := strings.ToLower(id)
+	if len(s) == 16 {
+		s = s[8:]
+	}
+	if isSerial(s) {
+		return true
+	}
+	_, err := net.ParseMAC(id)
+	return err == nil
+}
+
+func isSerial(s string) bool {
+	if len(s) != 8 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package netboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TFTP opcodes and error codes, see RFC 1350 and RFC 2347.
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+
+	errNotDefined      = 0
+	errFileNotFound    = 1
+	errAccessViolation = 2
+	errIllegalOp       = 4
+
+	defaultBlockSize = 512
+	// maxBlockSize is the largest block size that fits into an Ethernet frame without fragmentation.
+	maxBlockSize = 1468
+	retries      = 5
+	ackTimeout   = 3 * time.Second
+)
+
+// fileReader is a file served over TFTP.
+type fileReader interface {
+	io.ReadCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// ServeTFTP serves read requests received on the connection until it's closed. Every transfer is handled
+// on a new connection from an ephemeral port as required by the TFTP protocol. Writing files is not supported.
+func (s *Server) ServeTFTP(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		go s.handleTFTPRequest(conn, packet, addr)
+	}
+}
+
+func (s *Server) handleTFTPRequest(conn net.PacketConn, packet []byte, addr net.Addr) {
+	if len(packet) < 2 {
+		return
+	}
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	tconn, err := net.ListenPacket(conn.LocalAddr().Network(), net.JoinHostPort(host, "0"))
+	if err != nil {
+		fmt.Printf("TFTP: failed to open transfer connection: %v\n", err)
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tconn.Close()
+
+	switch binary.BigEndian.Uint16(packet) {
+	case opRRQ:
+	case opWRQ:
+		sendTFTPError(tconn, addr, errAccessViolation, "writing files is not supported")
+		return
+	default:
+		sendTFTPError(tconn, addr, errIllegalOp, "illegal TFTP operation")
+		return
+	}
+	filename, opts, err := parseRRQ(packet[2:])
+	if err != nil {
+		sendTFTPError(tconn, addr, errNotDefined, err.Error())
+		return
+	}
+	f, err := s.open(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			sendTFTPError(tconn, addr, errFileNotFound, "file not found")
+		} else {
+			fmt.Printf("TFTP: failed to open %q: %v\n", filename, err)
+			sendTFTPError(tconn, addr, errNotDefined, "failed to open file")
+		}
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer f.Close()
+	if err := sendFile(tconn, addr, f, opts); err != nil {
+		fmt.Printf("TFTP: failed to send %q to %s: %v\n", filename, addr, err)
+		return
+	}
+	fmt.Printf("TFTP: sent %q to %s\n", filename, addr)
+}
+
+// parseRRQ parses a read request: filename, mode, and optional option/value pairs separated by zero bytes.
+func parseRRQ(data []byte) (string, map[string]string, error) {
+	fields := strings.Split(string(data), "\x00")
+	if len(fields) < 3 {
+		return "", nil, fmt.Errorf("malformed read request")
+	}
+	filename, mode := fields[0], strings.ToLower(fields[1])
+	if mode != "octet" {
+		return "", nil, fmt.Errorf("only octet transfer mode is supported")
+	}
+	opts := map[string]string{}
+	// The last field is always empty as the request ends with a zero byte.
+	for i := 2; i+1 < len(fields); i += 2 {
+		opts[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return filename, opts, nil
+}
+
+// sendFile sends the file in blocks waiting for the acknowledgement of every block. The blksize (RFC 2348) and
+// tsize (RFC 2349) options are negotiated if requested.
+func sendFile(conn net.PacketConn, addr net.Addr, f fileReader, opts map[string]string) error {
+	blockSize := defaultBlockSize
+	oack := map[string]string{}
+	if v, ok := opts["blksize"]; ok {
+		if size, err := strconv.Atoi(v); err == nil && size >= 8 {
+			if size > maxBlockSize {
+				size = maxBlockSize
+			}
+			blockSize = size
+			oack["blksize"] = strconv.Itoa(size)
+		}
+	}
+	if _, ok := opts["tsize"]; ok {
+		if info, err := f.Stat(); err == nil {
+			oack["tsize"] = strconv.FormatInt(info.Size(), 10)
+		}
+	}
+	if len(oack) > 0 {
+		packet := []byte{0, opOACK}
+		for k, v := range oack {
+			packet = append(packet, k...)
+			packet = append(packet, 0)
+			packet = append(packet, v...)
+			packet = append(packet, 0)
+		}
+		if err := sendAndWaitAck(conn, addr, packet, 0); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, blockSize)
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			sendTFTPError(conn, addr, errNotDefined, "failed to read file")
+			return err
+		}
+		packet := make([]byte, 4+n)
+		binary.BigEndian.PutUint16(packet, opDATA)
+		binary.BigEndian.PutUint16(packet[2:], block)
+		copy(packet[4:], buf[:n])
+		if err := sendAndWaitAck(conn, addr, packet, block); err != nil {
+			return err
+		}
+		// A block shorter than the block size (including an empty one) terminates the transfer.
+		if n < blockSize {
+			return nil
+		}
+	}
+}
+
+// sendAndWaitAck sends the packet and waits for the acknowledgement of the block retransmitting the packet
+// on timeout.
+func sendAndWaitAck(conn net.PacketConn, addr net.Addr, packet []byte, block uint16) error {
+	buf := make([]byte, 1024)
+	for attempt := 0; attempt < retries; attempt++ {
+		if _, err := conn.WriteTo(packet, addr); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(ackTimeout)
+		for {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if from.String() != addr.String() || n < 4 {
+				// Ignore packets from other hosts, see RFC 1350 section 4.
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				// Duplicate acknowledgements of the previous blocks are ignored.
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case opERROR:
+				msg := bytes.TrimRight(buf[4:n], "\x00")
+				return fmt.Errorf("client error: %s", msg)
+			}
+		}
+	}
+	return fmt.Errorf("timeout waiting for acknowledgement of block %d", block)
+}
+
+func sendTFTPError(conn net.PacketConn, addr net.Addr, code uint16, msg string) {
+	packet := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(packet, opERROR)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, msg...)
+	packet = append(packet, 0)
+	_, _ = conn.WriteTo(packet, addr)
+}
+
+// bytesFile is an in-memory file served over TFTP.
+type bytesFile struct {
+	*bytes.Reader
+	size int64
+}
+
+func newBytesFile(data []byte) *bytesFile {
+	return &bytesFile{Reader: bytes.NewReader(data), size: int64(len(data))}
+}
+
+func (f *bytesFile) Close() error {
+	return nil
+}
+
+func (f *bytesFile) Stat() (fs.FileInfo, error) {
+	return bytesFileInfo{size: f.size}, nil
+}
+
+type bytesFileInfo struct {
+	size int64
+}
+
+func (i bytesFileInfo) Name() string       { return ConfigFilename }
+func (i bytesFileInfo) Size() int64        { return i.size }
+func (i bytesFileInfo) Mode() fs.FileMode  { return 0600 }
+func (i bytesFileInfo) ModTime() time.Time { return time.Time{} }
+func (i bytesFileInfo) IsDir() bool        { return false }
+func (i bytesFileInfo) Sys() interface{}   { return nil }
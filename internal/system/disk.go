@@ -0,0 +1,47 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// MoveFileFromDevice moves the file from the root of the file system labelled label to dst if the device with
+// the file system is attached. It returns false if there is no such device or the file doesn't exist on it.
+func MoveFileFromDevice(label, name, dst string) (bool, error) {
+	out, err := exec.Command("blkid", "-L", label).Output()
+	device := strings.TrimSpace(string(out))
+	if err != nil || device == "" {
+		return false, nil
+	}
+	mnt, err := os.MkdirTemp("", "hcos-")
+	if err != nil {
+		return false, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.Remove(mnt)
+	if out, err := exec.Command("mount", device, mnt).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to mount %s: %s", device, out)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer exec.Command("umount", mnt).Run()
+
+	src := filepath.Join(mnt, name)
+	data, err := os.ReadFile(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	// The file is copied as the device is a different file system.
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		return false, err
+	}
+	return true, os.Remove(src)
+}
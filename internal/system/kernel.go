@@ -0,0 +1,24 @@
+package system
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// LoadKernelModule loads the kernel module if it's not already loaded.
+func LoadKernelModule(name string) error {
+	out, err := exec.Command("modprobe", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to load kernel module %s: %s", name, out)
+	}
+	return nil
+}
+
+// SetSysctl sets the kernel parameter.
+func SetSysctl(key, value string) error {
+	out, err := exec.Command("sysctl", "-w", key+"="+value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set kernel parameter %s: %s", key, out)
+	}
+	return nil
+}
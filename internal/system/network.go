@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -38,3 +39,60 @@ func connManState() (string, error) {
 	}
 	return matches[1], nil
 }
+
+// SetMTU sets the MTU of the network interface.
+func SetMTU(iface string, mtu int) error {
+	cmd := exec.Command("ip", "link", "set", "dev", iface, "mtu", strconv.Itoa(mtu))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set MTU of interface %s to %d: %s", iface, mtu, out)
+	}
+	return nil
+}
+
+// WifiService is a Wi-Fi service known to ConnMan.
+type WifiService struct {
+	ID        string
+	Name      string
+	Connected bool
+}
+
+// ScanWifiServices scans for Wi-Fi networks in range and returns the services known to ConnMan. Hidden networks
+// without a name are skipped.
+func ScanWifiServices() ([]WifiService, error) {
+	if out, err := exec.Command("connmanctl", "scan", "wifi").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to scan Wi-Fi networks: %s", out)
+	}
+	out, err := exec.Command("connmanctl", "services").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ConnMan services: %s", out)
+	}
+	// Each line is formatted as "FLAGS NAME ID" where the flags take 4 characters, e.g. "*AR my-wifi wifi_...".
+	// R (ready) or O (online) means the service is connected.
+	var services []WifiService
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		flags, rest := line[:4], strings.TrimSpace(line[4:])
+		i := strings.LastIndex(rest, " ")
+		if i < 0 || !strings.HasPrefix(rest[i+1:], "wifi_") {
+			continue
+		}
+		services = append(services, WifiService{
+			ID:        rest[i+1:],
+			Name:      strings.TrimSpace(rest[:i]),
+			Connected: strings.ContainsAny(flags[2:], "RO"),
+		})
+	}
+	return services, nil
+}
+
+// ConnectService connects to the ConnMan service.
+func ConnectService(id string) error {
+	out, err := exec.Command("connmanctl", "connect", id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %s", id, out)
+	}
+	return nil
+}
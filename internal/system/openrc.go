@@ -13,3 +13,14 @@ func StartService(name string) error {
 	}
 	return nil
 }
+
+// RestartService restarts the service if it's already started. A service that hasn't been started yet picks up
+// the changes when it starts.
+func RestartService(name string) error {
+	cmd := exec.Command(fmt.Sprintf("/etc/init.d/%s", name), "--ifstarted", "restart")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to restart service %s: %s", name, out)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -14,49 +15,179 @@ type UserEntry struct {
 	Username string
 	Uid      int
 	Gid      int
+	Gecos    string
 	HomeDir  string
+	Shell    string
 }
 
 // GetUser parses /etc/passwd file and returns information about the system user.
 func GetUser(username string) (UserEntry, error) {
-	passwd, err := os.Open("/etc/passwd")
+	users, err := ListUsers()
 	if err != nil {
 		return UserEntry{}, err
 	}
+	for _, u := range users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return UserEntry{}, fmt.Errorf("cannot find %s user in /etc/passwd", username)
+}
+
+// ListUsers parses /etc/passwd file and returns all the system users.
+func ListUsers() ([]UserEntry, error) {
+	passwd, err := os.Open("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
 	//goland:noinspection GoUnhandledErrorResult
 	defer passwd.Close()
+	var users []UserEntry
 	scanner := bufio.NewScanner(passwd)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		fields := strings.Split(line, ":")
-		if len(fields) != 7 || fields[0] != username {
-			// Skip a potentially corrupted entry or the wrong user.
+		if len(fields) != 7 {
+			// Skip a potentially corrupted entry.
 			continue
 		}
 		uid, err := strconv.Atoi(fields[2])
 		if err != nil {
-			return UserEntry{}, fmt.Errorf("invalid UID for %s user in /etc/passwd", username)
+			return nil, fmt.Errorf("invalid UID for %s user in /etc/passwd", fields[0])
 		}
 		gid, err := strconv.Atoi(fields[3])
 		if err != nil {
-			return UserEntry{}, fmt.Errorf("invalid GID for %s user in /etc/passwd", username)
+			return nil, fmt.Errorf("invalid GID for %s user in /etc/passwd", fields[0])
 		}
-		return UserEntry{
+		users = append(users, UserEntry{
 			Username: fields[0],
 			Uid:      uid,
 			Gid:      gid,
+			Gecos:    fields[4],
 			HomeDir:  fields[5],
-		}, nil
+			Shell:    fields[6],
+		})
 	}
 	if err := scanner.Err(); err != nil {
-		return UserEntry{}, err
+		return nil, err
 	}
-	return UserEntry{}, fmt.Errorf("cannot find %s user in /etc/passwd", username)
+	return users, nil
+}
+
+// CreateUser creates a user with the UID and the password login disabled. The primary group of the user gets the same
+// ID. The home directory is only created if it doesn't exist, an existing one is kept as is.
+func CreateUser(username string, uid int, shell, gecos string) error {
+	args := []string{"-D", "-u", strconv.Itoa(uid), "-s", shell, "-g", gecos}
+	if _, err := os.Stat("/home/" + username); err == nil {
+		args = append(args, "-H")
+	}
+	return runUserCommand("adduser", append(args, username)...)
+}
+
+// ChownHome recursively changes the owner of the home directory of the user to the user and its primary group.
+func ChownHome(user UserEntry) error {
+	return filepath.Walk(user.HomeDir, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, user.Uid, user.Gid)
+	})
+}
+
+// DeleteUser deletes the user and its home directory.
+func DeleteUser(username string) error {
+	return runUserCommand("deluser", "--remove-home", username)
+}
+
+// SetShell changes the login shell of the user.
+func SetShell(username, shell string) error {
+	data, err := os.ReadFile("/etc/passwd")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == username {
+			fields[6] = shell
+			lines[i] = strings.Join(fields, ":")
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("cannot find %s user in /etc/passwd", username)
+	}
+	return os.WriteFile("/etc/passwd", []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// SetUserGroups makes the user a member of exactly the specified supplementary groups. The groups must exist.
+func SetUserGroups(username string, groups []string) error {
+	current, err := userGroups(username)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		wanted[g] = true
+		if !current[g] {
+			if err := runUserCommand("addgroup", username, g); err != nil {
+				return err
+			}
+		}
+	}
+	for g := range current {
+		if !wanted[g] {
+			if err := runUserCommand("delgroup", username, g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// userGroups parses /etc/group file and returns the supplementary groups the user is a member of.
+func userGroups(username string) (map[string]bool, error) {
+	data, err := os.ReadFile("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 4 || fields[3] == "" {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == username {
+				groups[fields[0]] = true
+			}
+		}
+	}
+	return groups, nil
+}
+
+// LockUser disables any logins of the user including the SSH key authentication.
+func LockUser(username string) error {
+	return runUserCommand("passwd", "-l", username)
+}
+
+// DisablePassword disables the password login of the user but keeps the SSH key authentication working.
+func DisablePassword(username string) error {
+	return SetPassword(username, "*")
+}
+
+func runUserCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s: %s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
 }
 
 func SetPassword(username, password string) error {
 	cmd := exec.Command("chpasswd")
-	if strings.HasPrefix(password, "$") {
+	if strings.HasPrefix(password, "$") || password == "*" {
 		cmd.Args = append(cmd.Args, "-e")
 	}
 	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s", username, password))
@@ -66,3 +197,29 @@ func SetPassword(username, password string) error {
 	}
 	return nil
 }
+
+// GetGroupID parses /etc/group file and returns the ID of the system group.
+func GetGroupID(name string) (int, error) {
+	group, err := os.Open("/etc/group")
+	if err != nil {
+		return 0, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer group.Close()
+	scanner := bufio.NewScanner(group)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 4 || fields[0] != name {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid GID for %s group in /etc/group", name)
+		}
+		return gid, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("cannot find %s group in /etc/group", name)
+}
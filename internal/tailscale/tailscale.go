@@ -78,3 +78,15 @@ func WaitIP() (string, error) {
 		time.Sleep(5 * time.Second)
 	}
 }
+
+// DNSName returns the MagicDNS name of the node without the trailing dot or an empty string if it's not known yet.
+func DNSName() (string, error) {
+	st, err := localClient.Status(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if st.Self == nil {
+		return "", nil
+	}
+	return strings.TrimSuffix(st.Self.DNSName, "."), nil
+}
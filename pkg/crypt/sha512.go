@@ -0,0 +1,171 @@
+// Package crypt implements the SHA-512 based crypt(3) password hashing scheme ("$6$") understood by chpasswd and
+// the C library on Linux so that passwords can be hashed before they leave the workstation.
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SHA512Prefix is the prefix of SHA-512 crypt hashes.
+	SHA512Prefix = "$6$"
+	// DefaultRounds is the number of rounds used when the hash doesn't specify it.
+	DefaultRounds = 5000
+
+	roundsPrefix  = "rounds="
+	minRounds     = 1000
+	maxRounds     = 999999999
+	maxSaltLength = 16
+	// alphabet is the crypt(3) variant of base64 used for salts and hashes.
+	alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// SHA512 hashes the password with a random salt using the default number of rounds.
+func SHA512(password string) (string, error) {
+	salt := make([]byte, maxSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	for i := range salt {
+		salt[i] = alphabet[int(salt[i])%len(alphabet)]
+	}
+	return sha512Crypt([]byte(password), salt, DefaultRounds, false), nil
+}
+
+// SHA512WithSalt hashes the password with the salt and parameters of an existing "$6$" hash (or just its prefix, e.g.
+// "$6$rounds=10000$salt$"). Comparing the result to the hash verifies the password.
+func SHA512WithSalt(password, hash string) (string, error) {
+	if !strings.HasPrefix(hash, SHA512Prefix) {
+		return "", fmt.Errorf("not a SHA-512 crypt hash")
+	}
+	params := strings.TrimPrefix(hash, SHA512Prefix)
+	rounds, customRounds := DefaultRounds, false
+	if strings.HasPrefix(params, roundsPrefix) {
+		value, rest, ok := strings.Cut(strings.TrimPrefix(params, roundsPrefix), "$")
+		if !ok {
+			return "", fmt.Errorf("invalid SHA-512 crypt hash rounds")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid SHA-512 crypt hash rounds: %w", err)
+		}
+		rounds, customRounds, params = n, true, rest
+		if rounds < minRounds {
+			rounds = minRounds
+		} else if rounds > maxRounds {
+			rounds = maxRounds
+		}
+	}
+	salt, _, _ := strings.Cut(params, "$")
+	if len(salt) > maxSaltLength {
+		salt = salt[:maxSaltLength]
+	}
+	return sha512Crypt([]byte(password), []byte(salt), rounds, customRounds), nil
+}
+
+// IsHash reports whether the value looks like a crypt(3) hash (e.g. "$6$...") rather than a plaintext password.
+func IsHash(value string) bool {
+	id, rest, ok := strings.Cut(strings.TrimPrefix(value, "$"), "$")
+	return strings.HasPrefix(value, "$") && ok && id != "" && rest != ""
+}
+
+// sha512Crypt implements the algorithm described in https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(key, salt []byte, rounds int, customRounds bool) string {
+	alt := sha512.New()
+	alt.Write(key)
+	alt.Write(salt)
+	alt.Write(key)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(key)
+	a.Write(salt)
+	for i := len(key); i > 0; i -= sha512.Size {
+		a.Write(altSum[:min(i, sha512.Size)])
+	}
+	for i := len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(key)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range key {
+		dp.Write(key)
+	}
+	p := repeat(dp.Sum(nil), len(key))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	for r := 0; r < rounds; r++ {
+		c := sha512.New()
+		if r&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if r%3 != 0 {
+			c.Write(s)
+		}
+		if r%7 != 0 {
+			c.Write(p)
+		}
+		if r&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(SHA512Prefix)
+	if customRounds {
+		b.WriteString(roundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	b.Write(salt)
+	b.WriteByte('$')
+	// The digest bytes are encoded in groups of three that are rotated for each group.
+	for i := 0; i < 21; i++ {
+		g := [3]byte{sum[i], sum[i+21], sum[i+42]}
+		r := i % 3
+		encode24(&b, g[r], g[(r+1)%3], g[(r+2)%3], 4)
+	}
+	encode24(&b, 0, 0, sum[63], 2)
+	return b.String()
+}
+
+// repeat returns a sequence of length n made of the repeated digest.
+func repeat(digest []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq) < n {
+		seq = append(seq, digest[:min(n-len(seq), len(digest))]...)
+	}
+	return seq
+}
+
+func encode24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		b.WriteByte(alphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
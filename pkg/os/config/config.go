@@ -2,9 +2,15 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"golang.org/x/crypto/pbkdf2"
 	yaml "gopkg.in/yaml.v3"
+	"hash/fnv"
+	"io"
 	"os"
+	"time"
 )
 
 const (
@@ -13,59 +19,406 @@ const (
 	ClusterInitRole  K3sRole = "cluster-init"
 	ControlPlaneRole K3sRole = "control-plane"
 	WorkerRole       K3sRole = "worker"
+
+	WifiSecurityPSK    WifiSecurity = "psk"
+	WifiSecurityNone   WifiSecurity = "none"
+	WifiSecurityWPAEAP WifiSecurity = "wpa-eap"
+
+	WifiEAPPEAP WifiEAP = "peap"
+	WifiEAPTTLS WifiEAP = "ttls"
+
+	IPMethodDHCP   IPMethod = "dhcp"
+	IPMethodStatic IPMethod = "static"
+	IPMethodOff    IPMethod = "off"
+
+	// DoasNone users can't run commands as root, DoasPassword users can after entering their password,
+	// DoasNoPass users can without a password.
+	DoasNone     DoasPrivilege = "none"
+	DoasPassword DoasPrivilege = "password"
+	DoasNoPass   DoasPrivilege = "nopass"
+
+	FileEncodingBase64 FileEncoding = "base64"
+
+	// BeforeK3sStage commands run after the built-in config steps but before K3s is started.
+	BeforeK3sStage CommandStage = "before-k3s"
+	// AfterK3sStage commands run after K3s service is started.
+	AfterK3sStage CommandStage = "after-k3s"
+
+	DefaultCommandTimeout = 5 * time.Minute
+
+	DefaultShell = "/bin/ash"
+	// LoginUsername is the built-in user configured with the top-level password and SSH keys.
+	LoginUsername = "hc"
+	// MinUserUID and MaxUserUID bound the UIDs of the users declared in the config so that they don't clash with
+	// the users shipped with the image.
+	MinUserUID = 2000
+	MaxUserUID = 59999
+)
+
+// Default network settings used when the corresponding fields are not set.
+var (
+	DefaultDNS                   = []string{"1.1.1.1"}
+	DefaultNTP                   = []string{"pool.ntp.org"}
+	DefaultPreferredTechnologies = []string{"ethernet", "wifi"}
+	DefaultInterfaceBlacklist    = []string{"veth"}
 )
 
 type K3sRole string
 
+type WifiSecurity string
+
+type WifiEAP string
+
+type IPMethod string
+
+type DoasPrivilege string
+
+type FileEncoding string
+
+type CommandStage string
+
+//go:generate go run gen_schema.go
+
 type Config struct {
-	Hostname          string        `yaml:"hostname"`
-	Password          string        `yaml:"password,omitempty"`
-	SSHAuthorizedKeys []string      `yaml:"ssh_authorized_keys"`
-	Network           NetworkConfig `yaml:"network"`
-	K3s               K3sConfig     `yaml:"k3s"`
+	// Version is the version of the config schema. Configs without a version are treated as version 0.
+	Version           int           `yaml:"version"`
+	Hostname          string        `yaml:"hostname" required:"true"`
+	Password          string        `yaml:"password,omitempty" secret:"true"`
+	SSHAuthorizedKeys []string      `yaml:"ssh_authorized_keys" merge:"append"`
+	Users             []UserConfig  `yaml:"users,omitempty" merge:"append"`
+	System            SystemConfig  `yaml:"system,omitempty"`
+	Network           NetworkConfig `yaml:"network" required:"true"`
+	K3s               K3sConfig     `yaml:"k3s" required:"true"`
+	// WriteFiles and RunCommands are applied in the order they are specified after the built-in config steps.
+	WriteFiles  []WriteFileConfig  `yaml:"write_files,omitempty" merge:"append"`
+	RunCommands []RunCommandConfig `yaml:"run_commands,omitempty" merge:"append"`
+}
+
+type SystemConfig struct {
+	Timezone string `yaml:"timezone,omitempty"`
+	Locale   string `yaml:"locale,omitempty"`
+	// Sysctl maps kernel parameter names to their values, e.g. net.ipv4.ip_forward: "1".
+	Sysctl        map[string]string `yaml:"sysctl,omitempty"`
+	KernelModules []string          `yaml:"kernel_modules,omitempty" merge:"append"`
+}
+
+type UserConfig struct {
+	Name string `yaml:"name" required:"true"`
+	// UID is pinned as the home directories are persisted across reboots while the account databases in /etc are not.
+	UID    int      `yaml:"uid,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+	Shell  string   `yaml:"shell,omitempty"`
+	// Password must be a crypt(3) hash as the config is stored in plain text.
+	Password          string        `yaml:"password,omitempty" secret:"true"`
+	SSHAuthorizedKeys []string      `yaml:"ssh_authorized_keys,omitempty"`
+	Doas              DoasPrivilege `yaml:"doas,omitempty"`
+	Lock              bool          `yaml:"lock,omitempty"`
+}
+
+// ShellOrDefault returns the login shell of the user taking into account the default value.
+func (c *UserConfig) ShellOrDefault() string {
+	if c.Shell == "" {
+		return DefaultShell
+	}
+	return c.Shell
+}
+
+// UIDOrDefault returns the UID of the user taking into account the default value derived from the user name.
+func (c *UserConfig) UIDOrDefault() int {
+	if c.UID != 0 {
+		return c.UID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(c.Name))
+	return MinUserUID + int(h.Sum32()%(MaxUserUID-MinUserUID+1))
+}
+
+// DoasOrDefault returns the doas privilege of the user taking into account the default value.
+func (c *UserConfig) DoasOrDefault() DoasPrivilege {
+	if c.Doas == "" {
+		return DoasNone
+	}
+	return c.Doas
 }
 
 type NetworkConfig struct {
-	Wifi      WifiConfig      `yaml:"wifi,omitempty"`
-	Tailscale TailscaleConfig `yaml:"tailscale"`
+	Interfaces []InterfaceConfig `yaml:"interfaces,omitempty" merge:"append"`
+	Wifi       []WifiConfig      `yaml:"wifi,omitempty" merge:"append"`
+	// DNS, NTP, PreferredTechnologies and InterfaceBlacklist fall back to the defaults if not set.
+	DNS                   []string        `yaml:"dns,omitempty"`
+	NTP                   []string        `yaml:"ntp,omitempty"`
+	PreferredTechnologies []string        `yaml:"preferred_technologies,omitempty"`
+	InterfaceBlacklist    []string        `yaml:"interface_blacklist,omitempty"`
+	Proxy                 ProxyConfig     `yaml:"proxy,omitempty"`
+	Tailscale             TailscaleConfig `yaml:"tailscale" required:"true"`
+}
+
+func (c *NetworkConfig) DNSOrDefault() []string {
+	if c.DNS == nil {
+		return DefaultDNS
+	}
+	return c.DNS
+}
+
+func (c *NetworkConfig) NTPOrDefault() []string {
+	if c.NTP == nil {
+		return DefaultNTP
+	}
+	return c.NTP
+}
+
+func (c *NetworkConfig) PreferredTechnologiesOrDefault() []string {
+	if c.PreferredTechnologies == nil {
+		return DefaultPreferredTechnologies
+	}
+	return c.PreferredTechnologies
+}
+
+func (c *NetworkConfig) InterfaceBlacklistOrDefault() []string {
+	if c.InterfaceBlacklist == nil {
+		return DefaultInterfaceBlacklist
+	}
+	return c.InterfaceBlacklist
+}
+
+// InterfaceConfig configures a wired network interface identified by its name or MAC address.
+type InterfaceConfig struct {
+	Name          string   `yaml:"name,omitempty"`
+	MAC           string   `yaml:"mac,omitempty"`
+	IPv4          IPConfig `yaml:"ipv4,omitempty"`
+	IPv6          IPConfig `yaml:"ipv6,omitempty"`
+	Nameservers   []string `yaml:"nameservers,omitempty"`
+	SearchDomains []string `yaml:"search_domains,omitempty"`
+	MTU           int      `yaml:"mtu,omitempty"`
+}
+
+type IPConfig struct {
+	Method IPMethod `yaml:"method,omitempty"`
+	// Address is an IP address with a prefix length in CIDR notation, e.g. 192.168.1.10/24.
+	Address string `yaml:"address,omitempty"`
+	Gateway string `yaml:"gateway,omitempty"`
+}
+
+// MethodOrDefault returns the address configuration method taking into account the default value.
+func (c *IPConfig) MethodOrDefault() IPMethod {
+	if c.Method == "" {
+		return IPMethodDHCP
+	}
+	return c.Method
 }
 
 type WifiConfig struct {
-	Name     string `yaml:"name"`
-	Password string `yaml:"password"`
+	Name string `yaml:"name" required:"true"`
+	// Password is a WPA passphrase for psk networks or a user password for wpa-eap networks.
+	Password string `yaml:"password,omitempty" secret:"true"`
+	Priority int    `yaml:"priority,omitempty"`
+	Hidden   bool   `yaml:"hidden,omitempty"`
+	// Security defaults to psk if the password is set, otherwise to none.
+	Security          WifiSecurity `yaml:"security,omitempty"`
+	EAP               WifiEAP      `yaml:"eap,omitempty"`
+	Identity          string       `yaml:"identity,omitempty"`
+	AnonymousIdentity string       `yaml:"anonymous_identity,omitempty"`
+	CACert            string       `yaml:"ca_cert,omitempty"`
+	Phase2            string       `yaml:"phase2,omitempty"`
+}
+
+// SecurityOrDefault returns the security of the network taking into account the default value.
+func (c *WifiConfig) SecurityOrDefault() WifiSecurity {
+	if c.Security != "" {
+		return c.Security
+	}
+	if c.Password != "" {
+		return WifiSecurityPSK
+	}
+	return WifiSecurityNone
+}
+
+// WithDerivedPSK returns the network with the WPA passphrase of a psk network replaced by the pre-shared key derived
+// from it so that the passphrase itself isn't stored. Secret references and invalid passphrases are left as is.
+func (c WifiConfig) WithDerivedPSK() WifiConfig {
+	if c.SecurityOrDefault() != WifiSecurityPSK || IsSecretRef(c.Password) ||
+		len(c.Password) < 8 || len(c.Password) > 63 {
+		return c
+	}
+	c.Password = DeriveWifiPSK(c.Name, c.Password)
+	return c
+}
+
+// DeriveWifiPSK derives the 256-bit WPA pre-shared key from the passphrase and SSID as defined in IEEE 802.11i and
+// returns it as 64 hex digits.
+func DeriveWifiPSK(ssid, passphrase string) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(passphrase), []byte(ssid), 4096, 32, sha1.New))
+}
+
+type ProxyConfig struct {
+	HTTP  string `yaml:"http,omitempty"`
+	HTTPS string `yaml:"https,omitempty"`
+	// NoProxy is extended with the cluster and Tailscale networks when the proxy is used.
+	NoProxy []string `yaml:"no_proxy,omitempty" merge:"append"`
+}
+
+func (c *ProxyConfig) Enabled() bool {
+	return c.HTTP != "" || c.HTTPS != ""
 }
 
 type TailscaleConfig struct {
-	AuthKey string `yaml:"auth_key"`
+	AuthKey string `yaml:"auth_key" required:"true" secret:"true"`
 }
 
 type K3sConfig struct {
-	Role   K3sRole `yaml:"role"`
+	Role   K3sRole `yaml:"role" required:"true"`
 	Server string  `yaml:"server,omitempty"`
-	Token  string  `yaml:"token"`
+	Token  string  `yaml:"token" required:"true" secret:"true"`
+	// The following fields are passed through to the k3s config file. Disable, KubeAPIServerArgs and TLSSAN are only
+	// supported by the server roles (cluster-init and control-plane).
+	NodeLabels        map[string]string `yaml:"node_labels,omitempty"`
+	NodeTaints        []string          `yaml:"node_taints,omitempty" merge:"append"`
+	Disable           []string          `yaml:"disable,omitempty" merge:"append"`
+	KubeletArgs       []string          `yaml:"kubelet_args,omitempty" merge:"append"`
+	KubeAPIServerArgs []string          `yaml:"kube_apiserver_args,omitempty" merge:"append"`
+	NodeIP            []string          `yaml:"node_ip,omitempty"`
+	NodeExternalIP    []string          `yaml:"node_external_ip,omitempty"`
+	TLSSAN            []string          `yaml:"tls_san,omitempty" merge:"append"`
+	// Extra contains other k3s config file options by their k3s names. Options that have a field above or are managed
+	// by the agent can't be set.
+	Extra map[string]interface{} `yaml:"extra,omitempty"`
+}
+
+// K3sDisableComponents are the packaged k3s components that can be disabled.
+var K3sDisableComponents = []string{"coredns", "servicelb", "traefik", "local-storage", "metrics-server"}
+
+// K3sManagedOptions are the k3s config file options generated from the OS config that can't be set in extra options.
+var K3sManagedOptions = []string{
+	"cluster-init", "server", "token", "node-name", "bind-address", "flannel-iface", "node-label", "node-taint",
+	"disable", "kubelet-arg", "kube-apiserver-arg", "node-ip", "node-external-ip", "tls-san",
+}
+
+// K3sTaintEffects are the valid effects of Kubernetes taints.
+var K3sTaintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// IsServer returns whether the role runs the k3s server (control plane).
+func (r K3sRole) IsServer() bool {
+	return r == ClusterInitRole || r == ControlPlaneRole
+}
+
+type WriteFileConfig struct {
+	Path     string       `yaml:"path" required:"true"`
+	Content  string       `yaml:"content,omitempty"`
+	Encoding FileEncoding `yaml:"encoding,omitempty"`
+	// Owner is a user name or UID optionally followed by a colon and a group name or GID.
+	Owner       string `yaml:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Append      bool   `yaml:"append,omitempty"`
 }
 
+type RunCommandConfig struct {
+	Stage   CommandStage `yaml:"stage,omitempty"`
+	Command string       `yaml:"command" required:"true"`
+	Timeout string       `yaml:"timeout,omitempty"`
+	Once    bool         `yaml:"once,omitempty"`
+}
+
+// StageOrDefault returns the stage of the command taking into account the default value.
+func (c *RunCommandConfig) StageOrDefault() CommandStage {
+	if c.Stage == "" {
+		return BeforeK3sStage
+	}
+	return c.Stage
+}
+
+// TimeoutOrDefault returns the timeout of the command taking into account the default value.
+func (c *RunCommandConfig) TimeoutOrDefault() (time.Duration, error) {
+	if c.Timeout == "" {
+		return DefaultCommandTimeout, nil
+	}
+	return time.ParseDuration(c.Timeout)
+}
+
+// ReadConfig reads the config file and merges the drop-in configs from the hcos.d directory next to it onto it.
+// See MergeDropIns for the merge rules.
 func ReadConfig(path string) (Config, error) {
-	data, err := os.ReadFile(path)
+	return readConfig(path, false)
+}
+
+// ReadConfigStrict reads the config file the same way as ReadConfig but returns an error if the file or any of
+// the drop-in configs contain unknown fields.
+func ReadConfigStrict(path string) (Config, error) {
+	return readConfig(path, true)
+}
+
+func readConfig(path string, strict bool) (Config, error) {
+	doc, err := MergeDropIns(path, strict, false)
 	if err != nil {
-		return Config{}, fmt.Errorf("unable to read config file %q: %w", path, err)
+		return Config{}, err
 	}
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	config, err := decodeDocument(doc, strict)
+	if err != nil {
 		return Config{}, fmt.Errorf("unable to parse config file %q: %w", path, err)
 	}
 	return config, nil
 }
 
-func (c *Config) Write(path string, perm os.FileMode) error {
+// ParseConfig parses the YAML config upgrading it to the current version if it's older. Configs of newer versions
+// are refused. Unknown fields are rejected if strict is true.
+func ParseConfig(data []byte, strict bool) (Config, error) {
+	doc, err := parseDocument(data)
+	if err != nil {
+		return Config{}, err
+	}
+	return decodeDocument(doc, strict)
+}
+
+// parseDocument parses the YAML config document and upgrades it to the current version. An empty document is
+// returned as an empty mapping node.
+func parseDocument(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	if _, err := migrate(doc.Content[0]); err != nil {
+		return nil, err
+	}
+	return doc.Content[0], nil
+}
+
+func decodeDocument(doc *yaml.Node, strict bool) (Config, error) {
+	// Node.Decode doesn't support rejecting unknown fields so the document is encoded back to use a decoder.
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return Config{}, err
+	}
+	config := Config{Version: CurrentVersion}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Marshal serializes the config as YAML of the current version.
+func (c *Config) Marshal() ([]byte, error) {
+	cfg := *c
+	cfg.Version = CurrentVersion
 	var data bytes.Buffer
 	enc := yaml.NewEncoder(&data)
 	enc.SetIndent(2)
-	if err := enc.Encode(c); err != nil {
-		return err
+	if err := enc.Encode(&cfg); err != nil {
+		return nil, err
 	}
 	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func (c *Config) Write(path string, perm os.FileMode) error {
+	data, err := c.Marshal()
+	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data.Bytes(), perm)
+	return os.WriteFile(path, data, perm)
 }
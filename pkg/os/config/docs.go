@@ -0,0 +1,113 @@
+package config
+
+// fieldDocs contains descriptions of the config fields for the JSON Schema keyed by TYPE.FIELD. Every field of
+// the config types must be documented here, otherwise the schema generation fails.
+var fieldDocs = map[string]string{
+	"Config.Version":  "Version of the config schema.",
+	"Config.Hostname": "Hostname of the node, must be a valid RFC 1123 hostname.",
+	"Config.Password": "Password of the hc user. Should be a crypt(3) hash, e.g. generated with hc node " +
+		"create --password-prompt or mkpasswd -m sha-512, as the config is stored in plain text.",
+	"Config.SSHAuthorizedKeys": "SSH public keys authorised to log in as the hc user.",
+	"Config.Users": "Additional login users. Users created by the agent are removed along with their home " +
+		"directories when they are no longer declared.",
+	"Config.System":      "Operating system settings.",
+	"Config.Network":     "Network settings.",
+	"Config.K3s":         "Kubernetes (k3s) settings.",
+	"Config.WriteFiles":  "Files to write after the built-in config steps.",
+	"Config.RunCommands": "Shell commands to run after the files are written.",
+
+	"SystemConfig.Timezone": "Time zone name from the IANA database, e.g. Europe/London. Defaults to UTC. " +
+		"It's applied by the agent on every boot so the services started before it log in UTC.",
+	"SystemConfig.Locale": "Locale of the login shells, e.g. en_GB.UTF-8. It's applied by the agent on every " +
+		"boot so it only affects the shells started after the config is applied.",
+	"SystemConfig.Sysctl":        "Kernel parameters, e.g. net.ipv4.ip_forward: \"1\".",
+	"SystemConfig.KernelModules": "Kernel modules to load at boot, e.g. br_netfilter.",
+
+	"UserConfig.Name": "Login name of the user.",
+	"UserConfig.UID": "UID of the user between 2000 and 59999. Defaults to a UID derived from the name so " +
+		"that the files in the persistent home directory keep their owner.",
+	"UserConfig.Groups": "Supplementary groups of the user.",
+	"UserConfig.Shell":  "Login shell of the user. Defaults to /bin/ash.",
+	"UserConfig.Password": "Hashed password of the user, e.g. generated with mkpasswd -m sha-512. Password " +
+		"login is disabled if not set.",
+	"UserConfig.SSHAuthorizedKeys": "SSH public keys authorised to log in as the user.",
+	"UserConfig.Doas": "Whether the user can run commands as root with doas: none (default), password, " +
+		"or nopass.",
+	"UserConfig.Lock": "Lock the account to disable any logins.",
+
+	"NetworkConfig.Interfaces": "Settings of the wired network interfaces.",
+	"NetworkConfig.Wifi":       "Wi-Fi networks to connect to.",
+	"NetworkConfig.DNS": "DNS servers used when the network doesn't provide any. Defaults to " +
+		"1.1.1.1.",
+	"NetworkConfig.NTP": "NTP servers used when the network doesn't provide any. Defaults to " +
+		"pool.ntp.org.",
+	"NetworkConfig.PreferredTechnologies": "Network technologies in the order of preference. Defaults to ethernet, " +
+		"wifi.",
+	"NetworkConfig.InterfaceBlacklist": "Prefixes of network interface names that are not managed. Defaults to " +
+		"veth.",
+	"NetworkConfig.Proxy":     "HTTP(S) proxy used to access the internet.",
+	"NetworkConfig.Tailscale": "Tailscale VPN settings.",
+
+	"InterfaceConfig.Name":          "Name of the interface, e.g. eth0. Either name or mac must be set.",
+	"InterfaceConfig.MAC":           "MAC address of the interface. Either name or mac must be set.",
+	"InterfaceConfig.IPv4":          "IPv4 settings of the interface.",
+	"InterfaceConfig.IPv6":          "IPv6 settings of the interface.",
+	"InterfaceConfig.Nameservers":   "IP addresses of DNS servers to use instead of the ones obtained via DHCP.",
+	"InterfaceConfig.SearchDomains": "DNS search domains.",
+	"InterfaceConfig.MTU":           "MTU of the interface.",
+
+	"IPConfig.Method":  "How to configure the address: dhcp (default, SLAAC/DHCPv6 for IPv6), static, or off.",
+	"IPConfig.Address": "Static IP address with a prefix length in CIDR notation, e.g. 192.168.1.10/24.",
+	"IPConfig.Gateway": "Default gateway of the static address.",
+
+	"WifiConfig.Name": "Name (SSID) of the Wi-Fi network.",
+	"WifiConfig.Password": "WPA passphrase (8-63 characters) or 64 hex digits pre-shared key for psk " +
+		"networks, user password for wpa-eap networks. hc stores only the pre-shared key derived from the passphrase.",
+	"WifiConfig.Priority": "Networks with a higher priority are preferred when several networks are in " +
+		"range. The agent connects to the preferred network when the config is applied on boot, afterwards " +
+		"ConnMan reconnects to any network in range.",
+	"WifiConfig.Hidden": "Whether the network doesn't broadcast its name.",
+	"WifiConfig.Security": "Security of the network. Defaults to psk if the password is set, otherwise to " +
+		"none.",
+	"WifiConfig.EAP":               "EAP method of a wpa-eap network.",
+	"WifiConfig.Identity":          "User identity of a wpa-eap network.",
+	"WifiConfig.AnonymousIdentity": "Anonymous outer identity of a wpa-eap network.",
+	"WifiConfig.CACert": "PEM encoded CA certificate to verify the authentication server of a wpa-eap " +
+		"network.",
+	"WifiConfig.Phase2": "Inner authentication method of a wpa-eap network, e.g. mschapv2 for PEAP or pap " +
+		"for TTLS.",
+
+	"ProxyConfig.HTTP":  "URL of the proxy for HTTP requests, e.g. http://proxy.lan:3128.",
+	"ProxyConfig.HTTPS": "URL of the proxy for HTTPS requests, e.g. http://proxy.lan:3128.",
+	"ProxyConfig.NoProxy": "Hosts, domains and CIDRs to access directly. The cluster and Tailscale networks are " +
+		"added automatically.",
+
+	"TailscaleConfig.AuthKey": "Auth key used to join the node to the tailnet.",
+
+	"K3sConfig.Role": "Role of the node in the cluster.",
+	"K3sConfig.Server": "URL of the cluster server to join, e.g. https://hostname:6443. Required for all " +
+		"roles except cluster-init.",
+	"K3sConfig.Token":             "Shared secret used to join the cluster.",
+	"K3sConfig.NodeLabels":        "Kubernetes labels to register the node with.",
+	"K3sConfig.NodeTaints":        "Kubernetes taints to register the node with, e.g. dedicated=gpu:NoSchedule.",
+	"K3sConfig.Disable":           "Packaged components not to deploy, e.g. traefik or servicelb. Server roles only.",
+	"K3sConfig.KubeletArgs":       "Extra kubelet flags, e.g. max-pods=200.",
+	"K3sConfig.KubeAPIServerArgs": "Extra kube-apiserver flags. Server roles only.",
+	"K3sConfig.NodeIP":            "IP addresses to advertise for the node.",
+	"K3sConfig.NodeExternalIP":    "External IP addresses to advertise for the node.",
+	"K3sConfig.TLSSAN": "Additional host names and IP addresses for the server TLS certificate. The " +
+		"Tailscale name and IP of the node are added automatically. Server roles only.",
+	"K3sConfig.Extra": "Other k3s config file options, e.g. write-kubeconfig-mode: \"0644\".",
+
+	"WriteFileConfig.Path":        "Absolute path of the file.",
+	"WriteFileConfig.Content":     "Content of the file.",
+	"WriteFileConfig.Encoding":    "Encoding of the content. Defaults to plain text.",
+	"WriteFileConfig.Owner":       "Owner of the file in the user[:group] form. Defaults to root.",
+	"WriteFileConfig.Permissions": "Octal file permissions, e.g. 0644. Defaults to 0644.",
+	"WriteFileConfig.Append":      "Append the content to the file unless the file already contains it.",
+
+	"RunCommandConfig.Stage":   "When to run the command: before-k3s (default) or after-k3s.",
+	"RunCommandConfig.Command": "Shell command to run.",
+	"RunCommandConfig.Timeout": "Maximum duration of the command, e.g. 30s. Defaults to 5m.",
+	"RunCommandConfig.Once":    "Run the command only until it succeeds once instead of on every boot.",
+}
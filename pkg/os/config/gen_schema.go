@@ -0,0 +1,21 @@
+//go:build ignore
+
+// gen_schema generates the JSON Schema file for the current config version. Run it with go generate after changing
+// the config types to keep the published schema in sync.
+package main
+
+import (
+	"github.com/psviderski/homecloud/pkg/os/config"
+	"log"
+	"os"
+)
+
+func main() {
+	schema, err := config.Schema()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(config.SchemaFilename, schema, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
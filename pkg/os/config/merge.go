@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// DropInDirName is the name of the directory next to the config file with drop-in configs merged onto it.
+const DropInDirName = "hcos.d"
+
+// appendFields are the YAML paths of the list fields tagged with merge:"append".
+var appendFields = listAppendFields(reflect.TypeOf(Config{}), "")
+
+// MergeDropIns reads the config file and deep-merges the drop-in configs (*.yaml) from the hcos.d directory next to
+// it onto it in lexical order of their names. Each file is upgraded to the current version before merging.
+// The merge rules are:
+//   - mappings are merged key by key recursively;
+//   - lists replace the current ones except the fields tagged with merge:"append" whose items are appended;
+//   - other values replace the current ones;
+//   - an explicit null deletes the key.
+//
+// If strict is true, unknown fields in any of the files are rejected. If annotate is true, each value in the returned
+// document has a line comment with the name of the file it comes from.
+func MergeDropIns(path string, strict, annotate bool) (*yaml.Node, error) {
+	dropIns, err := filepath.Glob(filepath.Join(filepath.Dir(path), DropInDirName, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var doc *yaml.Node
+	for i, p := range append([]string{path}, dropIns...) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %q: %w", p, err)
+		}
+		d, err := parseDocument(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse config file %q: %w", p, err)
+		}
+		if d.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("config file %q must be a YAML mapping", p)
+		}
+		if strict {
+			if _, err := decodeDocument(d, true); err != nil {
+				return nil, fmt.Errorf("unable to parse config file %q: %w", p, err)
+			}
+		}
+		if annotate {
+			source, err := filepath.Rel(filepath.Dir(path), p)
+			if err != nil {
+				source = p
+			}
+			annotateSource(d, source)
+		}
+		if i == 0 {
+			doc = d
+		} else {
+			mergeNodes(doc, d, "")
+		}
+	}
+	return doc, nil
+}
+
+func mergeNodes(dst, src *yaml.Node, path string) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		fieldPath := key.Value
+		if path != "" {
+			fieldPath = path + "." + key.Value
+		}
+		idx := -1
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				idx = j
+				break
+			}
+		}
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			if idx >= 0 {
+				dst.Content = append(dst.Content[:idx], dst.Content[idx+2:]...)
+			}
+			continue
+		}
+		if idx < 0 {
+			dst.Content = append(dst.Content, key, value)
+			continue
+		}
+		current := dst.Content[idx+1]
+		switch {
+		case current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			mergeNodes(current, value, fieldPath)
+		case current.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode && appendFields[fieldPath]:
+			current.Content = append(current.Content, value.Content...)
+		default:
+			dst.Content[idx+1] = value
+		}
+	}
+}
+
+// annotateSource replaces the comments of the document with the source file name on each value. Flow style is
+// switched to block style as comments can't be placed inside flow collections.
+func annotateSource(node *yaml.Node, source string) {
+	node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+	node.Style &^= yaml.FlowStyle
+	if len(node.Content) == 0 {
+		node.LineComment = source
+		return
+	}
+	for i, n := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+			continue
+		}
+		annotateSource(n, source)
+	}
+}
+
+// listAppendFields returns the YAML paths of the list fields tagged with merge:"append" in the struct type.
+func listAppendFields(t reflect.Type, path string) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		switch f.Type.Kind() {
+		case reflect.Slice:
+			if f.Tag.Get("merge") == "append" {
+				fields[name] = true
+			}
+		case reflect.Struct:
+			for k := range listAppendFields(f.Type, name) {
+				fields[k] = true
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SchemaFilename is the name of the generated JSON Schema file for the current config version.
+const SchemaFilename = "hcos.schema.json"
+
+// schemaEnums lists allowed values of the config types that are rendered as enums in the schema.
+var schemaEnums = map[reflect.Type][]interface{}{
+	reflect.TypeOf(K3sRole("")):       {ClusterInitRole, ControlPlaneRole, WorkerRole},
+	reflect.TypeOf(WifiSecurity("")):  {WifiSecurityPSK, WifiSecurityNone, WifiSecurityWPAEAP},
+	reflect.TypeOf(WifiEAP("")):       {WifiEAPPEAP, WifiEAPTTLS},
+	reflect.TypeOf(IPMethod("")):      {IPMethodDHCP, IPMethodStatic, IPMethodOff},
+	reflect.TypeOf(FileEncoding("")):  {FileEncodingBase64},
+	reflect.TypeOf(DoasPrivilege("")): {DoasNone, DoasPassword, DoasNoPass},
+	reflect.TypeOf(CommandStage("")):  {BeforeK3sStage, AfterK3sStage},
+}
+
+// SchemaID returns the identifier of the JSON Schema for the config version.
+func SchemaID(version int) string {
+	return fmt.Sprintf("https://github.com/psviderski/homecloud/schema/hcos-v%d.schema.json", version)
+}
+
+// Schema generates a JSON Schema of the current config version from the Config type. Field names are taken from
+// the yaml tags, descriptions from fieldDocs, and fields with the required:"true" tag are marked as required. It fails
+// if a field isn't documented or fieldDocs documents a field that doesn't exist.
+func Schema() ([]byte, error) {
+	g := schemaGenerator{unused: map[string]bool{}}
+	for key := range fieldDocs {
+		g.unused[key] = true
+	}
+	schema := g.typeSchema(reflect.TypeOf(Config{}))
+	if len(g.undocumented) > 0 {
+		return nil, fmt.Errorf("undocumented config fields: %s", strings.Join(g.undocumented, ", "))
+	}
+	if len(g.unused) > 0 {
+		stale := make([]string, 0, len(g.unused))
+		for key := range g.unused {
+			stale = append(stale, key)
+		}
+		sort.Strings(stale)
+		return nil, fmt.Errorf("docs of unknown config fields: %s", strings.Join(stale, ", "))
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaID(CurrentVersion)
+	schema["title"] = "Home Cloud OS config"
+	version := schema["properties"].(map[string]interface{})[versionKey].(map[string]interface{})
+	version["const"] = CurrentVersion
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// schemaGenerator tracks the field docs used while generating the schema.
+type schemaGenerator struct {
+	unused       map[string]bool
+	undocumented []string
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type) map[string]interface{} {
+	if enum, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": enum}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Interface:
+		// Any value.
+		return map[string]interface{}{}
+	case reflect.Struct:
+		return g.structSchema(t)
+	}
+	panic(fmt.Sprintf("unsupported config type %s", t))
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			inline := g.typeSchema(f.Type)
+			for k, v := range inline["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			if req, ok := inline["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		prop := g.typeSchema(f.Type)
+		key := t.Name() + "." + f.Name
+		delete(g.unused, key)
+		if doc, ok := fieldDocs[key]; !ok {
+			g.undocumented = append(g.undocumented, key)
+		} else {
+			if f.Tag.Get("secret") == "true" {
+				doc += " Accepts a secret reference: file:/path, env:VAR, or sealed:BASE64."
+			}
+			if f.Tag.Get("merge") == "append" {
+				doc += " Items from drop-in configs are appended."
+			}
+			prop["description"] = doc
+		}
+		props[name] = prop
+		if f.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Secret fields accept references to the values instead of the plain values:
+	//   - file:/path reads the value from the file on the node (a trailing newline is trimmed);
+	//   - env:VAR reads the value from the agent environment variable;
+	//   - sealed:BASE64 decrypts the value sealed to the node key with SealSecrets.
+	SecretFilePrefix   = "file:"
+	SecretEnvPrefix    = "env:"
+	SecretSealedPrefix = "sealed:"
+
+	// NodeKeyFilename is the name of the file with the node private key used to unseal the sealed secrets.
+	// It's installed next to the config file.
+	NodeKeyFilename    = "hcos.key"
+	DefaultNodeKeyPath = "/usr/local/cloud-config/" + NodeKeyFilename
+)
+
+// IsSecretRef checks if the value is a reference to a secret rather than the secret itself.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretFilePrefix) || strings.HasPrefix(value, SecretEnvPrefix) ||
+		strings.HasPrefix(value, SecretSealedPrefix)
+}
+
+// validateSecretRef checks the syntax of the secret reference without resolving it.
+func validateSecretRef(ref string) error {
+	switch {
+	case strings.HasPrefix(ref, SecretFilePrefix):
+		if !filepath.IsAbs(strings.TrimPrefix(ref, SecretFilePrefix)) {
+			return fmt.Errorf("file reference must be an absolute path, e.g. file:/etc/secret")
+		}
+	case strings.HasPrefix(ref, SecretEnvPrefix):
+		if strings.TrimPrefix(ref, SecretEnvPrefix) == "" {
+			return fmt.Errorf("env reference must be an environment variable name, e.g. env:SECRET")
+		}
+	case strings.HasPrefix(ref, SecretSealedPrefix):
+		if _, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, SecretSealedPrefix)); err != nil {
+			return fmt.Errorf("sealed reference must be base64 encoded")
+		}
+	}
+	return nil
+}
+
+// secretFields returns pointers to the fields of the config that contain secrets and accept secret references.
+func (c *Config) secretFields() []*string {
+	fields := []*string{&c.Password, &c.Network.Tailscale.AuthKey, &c.K3s.Token}
+	for i := range c.Users {
+		fields = append(fields, &c.Users[i].Password)
+	}
+	for i := range c.Network.Wifi {
+		fields = append(fields, &c.Network.Wifi[i].Password)
+	}
+	return fields
+}
+
+// GenerateNodeKey generates a new node private key and returns it encoded as the content of the node key file.
+func GenerateNodeKey() ([]byte, error) {
+	_, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(priv[:]) + "\n"), nil
+}
+
+// parseNodeKey decodes the node key file content and returns the public and private keys.
+func parseNodeKey(data []byte) (*[32]byte, *[32]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, nil, fmt.Errorf("invalid node key, must be a base64 encoded 32 bytes key")
+	}
+	var priv, pub [32]byte
+	copy(priv[:], key)
+	pubKey, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(pub[:], pubKey)
+	return &pub, &priv, nil
+}
+
+// SealSecrets returns a copy of the config with all plain secret values sealed to the node key so that they can
+// only be decrypted on the node with the key. Secret references are left unchanged.
+func (c Config) SealSecrets(nodeKey []byte) (Config, error) {
+	pub, _, err := parseNodeKey(nodeKey)
+	if err != nil {
+		return Config{}, err
+	}
+	// Copy the slices with secret fields to not modify the original config.
+	c.Users = append([]UserConfig(nil), c.Users...)
+	c.Network.Wifi = append([]WifiConfig(nil), c.Network.Wifi...)
+	for _, f := range c.secretFields() {
+		if *f == "" || IsSecretRef(*f) {
+			continue
+		}
+		sealed, err := box.SealAnonymous(nil, []byte(*f), pub, rand.Reader)
+		if err != nil {
+			return Config{}, err
+		}
+		*f = SecretSealedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+	return c, nil
+}
+
+// UnsealSecrets returns a copy of the config with all sealed secret values decrypted with the node key. Other secret
+// references are left unchanged.
+func (c Config) UnsealSecrets(nodeKey []byte) (Config, error) {
+	pub, priv, err := parseNodeKey(nodeKey)
+	if err != nil {
+		return Config{}, err
+	}
+	c.Users = append([]UserConfig(nil), c.Users...)
+	c.Network.Wifi = append([]WifiConfig(nil), c.Network.Wifi...)
+	for _, f := range c.secretFields() {
+		if !strings.HasPrefix(*f, SecretSealedPrefix) {
+			continue
+		}
+		if *f, err = unseal(*f, pub, priv); err != nil {
+			return Config{}, err
+		}
+	}
+	return c, nil
+}
+
+// HasSealedSecrets checks if any secret value of the config is sealed to a node key.
+func (c *Config) HasSealedSecrets() bool {
+	for _, f := range c.secretFields() {
+		if strings.HasPrefix(*f, SecretSealedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unseal decrypts the sealed secret reference with the node key.
+func unseal(ref string, pub, priv *[32]byte) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, SecretSealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("sealed secret is not base64 encoded")
+	}
+	secret, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+	if !ok {
+		return "", fmt.Errorf("unable to unseal secret, it's sealed to a different node key")
+	}
+	return string(secret), nil
+}
+
+// SecretResolver resolves secret references on the node. Resolved values must never be logged.
+type SecretResolver struct {
+	// Root is a path prefix for the files referenced by file references.
+	Root string
+	// NodeKeyPath is a path to the node key file used to unseal the sealed secrets.
+	NodeKeyPath string
+}
+
+// Resolve returns the secret value the reference points to or the value itself if it's not a reference.
+// Errors don't include the secret values.
+func (r *SecretResolver) Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SecretFilePrefix):
+		path := strings.TrimPrefix(value, SecretFilePrefix)
+		data, err := os.ReadFile(filepath.Join(r.Root, path))
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file %q: %w", path, err)
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+	case strings.HasPrefix(value, SecretEnvPrefix):
+		name := strings.TrimPrefix(value, SecretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, SecretSealedPrefix):
+		keyData, err := os.ReadFile(r.NodeKeyPath)
+		if err != nil {
+			return "", fmt.Errorf("unable to read node key to unseal secret: %w", err)
+		}
+		pub, priv, err := parseNodeKey(keyData)
+		if err != nil {
+			return "", err
+		}
+		return unseal(value, pub, priv)
+	}
+	return value, nil
+}
@@ -0,0 +1,634 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/psviderski/homecloud/pkg/crypt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostnameLabelRegexp matches a hostname label as defined in RFC 1123.
+var hostnameLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+var (
+	timezoneRegexp     = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	localeRegexp       = regexp.MustCompile(`^[A-Za-z_]+(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+	sysctlRegexp       = regexp.MustCompile(`^[a-zA-Z0-9_-]+([./][a-zA-Z0-9_*:-]+)*$`)
+	kernelModuleRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+var (
+	// labelNameRegexp matches a Kubernetes label name and value (unless empty), and the name part of a label key.
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]{0,61}[a-zA-Z0-9])?$`)
+	// k3sOptionRegexp matches a k3s config file option name, e.g. write-kubeconfig-mode.
+	k3sOptionRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+)
+
+// usernameRegexp matches a portable user or group name.
+var usernameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// FieldError describes an invalid config field identified by its YAML path, e.g. network.wifi.name.
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationError contains all invalid fields found in a config.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// validator collects field errors.
+type validator struct {
+	errs []*FieldError
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// secretRef checks the syntax of the value if it's a secret reference and returns whether it's a reference.
+func (v *validator) secretRef(path, value string) bool {
+	if !IsSecretRef(value) {
+		return false
+	}
+	if err := validateSecretRef(value); err != nil {
+		v.add(path, "%v", err)
+	}
+	return true
+}
+
+// Validate checks the config and returns a *ValidationError with all invalid fields or nil if the config is valid.
+func (c *Config) Validate() error {
+	v := &validator{}
+	if c.Version != 0 && c.Version != CurrentVersion {
+		v.add("version", "unsupported version %d, the current version is %d", c.Version, CurrentVersion)
+	}
+	if err := ValidateHostname(c.Hostname); err != nil {
+		v.add("hostname", "%v", err)
+	}
+	v.secretRef("password", c.Password)
+	for i, key := range c.SSHAuthorizedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			v.add(fmt.Sprintf("ssh_authorized_keys[%d]", i), "invalid SSH public key: %v", err)
+		}
+	}
+	users := map[string]bool{}
+	uids := map[int]string{}
+	for i := range c.Users {
+		userPath := fmt.Sprintf("users[%d]", i)
+		c.Users[i].validate(v, userPath)
+		if users[c.Users[i].Name] {
+			v.add(userPath+".name", "user %q is specified more than once", c.Users[i].Name)
+		}
+		users[c.Users[i].Name] = true
+		uid := c.Users[i].UIDOrDefault()
+		if other, ok := uids[uid]; ok && other != c.Users[i].Name {
+			v.add(userPath+".uid", "UID %d is also used by user %q, set a different uid", uid, other)
+		}
+		uids[uid] = c.Users[i].Name
+	}
+	c.System.validate(v, "system")
+	c.Network.validate(v, "network")
+	c.K3s.validate(v, "k3s")
+	for i := range c.WriteFiles {
+		c.WriteFiles[i].validate(v, fmt.Sprintf("write_files[%d]", i))
+	}
+	for i := range c.RunCommands {
+		c.RunCommands[i].validate(v, fmt.Sprintf("run_commands[%d]", i))
+	}
+	if len(v.errs) > 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
+
+// Warnings returns valid but unsafe fields of the config, e.g. a password stored in plain text.
+func (c *Config) Warnings() []*FieldError {
+	var warnings []*FieldError
+	if c.Password != "" && !IsSecretRef(c.Password) && !crypt.IsHash(c.Password) {
+		warnings = append(warnings, &FieldError{
+			Path:    "password",
+			Message: "password is stored in plain text, use a crypt(3) hash or a secret reference instead",
+		})
+	}
+	return warnings
+}
+
+// ValidateHostname checks that the hostname is valid according to RFC 1123.
+func ValidateHostname(hostname string) error {
+	if hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+	if len(hostname) > 253 {
+		return fmt.Errorf("hostname must be at most 253 characters long")
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostnameLabelRegexp.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q: each dot separated label must be 1-63 characters long, "+
+				"contain only letters, digits, and hyphens, and must not start or end with a hyphen", hostname)
+		}
+	}
+	return nil
+}
+
+func (c *NetworkConfig) validate(v *validator, path string) {
+	ifaces := map[string]bool{}
+	for i := range c.Interfaces {
+		ifacePath := fmt.Sprintf("%s.interfaces[%d]", path, i)
+		c.Interfaces[i].validate(v, ifacePath)
+		id := c.Interfaces[i].Name + "/" + strings.ToLower(c.Interfaces[i].MAC)
+		if ifaces[id] {
+			v.add(ifacePath, "interface is specified more than once")
+		}
+		ifaces[id] = true
+	}
+	names := map[string]bool{}
+	for i := range c.Wifi {
+		wifiPath := fmt.Sprintf("%s.wifi[%d]", path, i)
+		c.Wifi[i].validate(v, wifiPath)
+		if names[c.Wifi[i].Name] {
+			v.add(wifiPath+".name", "Wi-Fi network %q is specified more than once", c.Wifi[i].Name)
+		}
+		names[c.Wifi[i].Name] = true
+	}
+	for i, ns := range c.DNS {
+		if net.ParseIP(ns) == nil {
+			v.add(fmt.Sprintf("%s.dns[%d]", path, i), "invalid IP address %q", ns)
+		}
+	}
+	for i, server := range c.NTP {
+		if net.ParseIP(server) == nil && ValidateHostname(server) != nil {
+			v.add(fmt.Sprintf("%s.ntp[%d]", path, i), "invalid hostname or IP address %q", server)
+		}
+	}
+	for i, tech := range c.PreferredTechnologies {
+		if !contains(networkTechnologies, tech) {
+			v.add(fmt.Sprintf("%s.preferred_technologies[%d]", path, i), "technology must be one of: %s",
+				strings.Join(networkTechnologies, ", "))
+		}
+	}
+	for i, prefix := range c.InterfaceBlacklist {
+		if prefix == "" || strings.ContainsAny(prefix, ", \t") {
+			v.add(fmt.Sprintf("%s.interface_blacklist[%d]", path, i),
+				"interface name prefix must be non-empty and must not contain commas or spaces")
+		}
+	}
+	c.Proxy.validate(v, path+".proxy")
+	if c.Tailscale.AuthKey == "" {
+		v.add(path+".tailscale.auth_key", "Tailscale auth key is required")
+	}
+	v.secretRef(path+".tailscale.auth_key", c.Tailscale.AuthKey)
+}
+
+func (c *ProxyConfig) validate(v *validator, path string) {
+	proxies := []struct{ field, url string }{{"http", c.HTTP}, {"https", c.HTTPS}}
+	for _, p := range proxies {
+		if p.url == "" {
+			continue
+		}
+		if u, err := url.Parse(p.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(path+"."+p.field, "proxy must be an http or https URL, e.g. http://proxy.lan:3128")
+		}
+	}
+	for i, host := range c.NoProxy {
+		if host == "" || strings.ContainsAny(host, ", \t") {
+			v.add(fmt.Sprintf("%s.no_proxy[%d]", path, i), "entry must be non-empty and must not contain commas or spaces")
+		}
+	}
+	if len(c.NoProxy) > 0 && !c.Enabled() {
+		v.add(path+".no_proxy", "no_proxy requires http or https proxy to be set")
+	}
+}
+
+// networkTechnologies are the network technologies supported by ConnMan.
+var networkTechnologies = []string{"ethernet", "wifi", "bluetooth", "cellular", "gadget"}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *InterfaceConfig) validate(v *validator, path string) {
+	if (c.Name == "") == (c.MAC == "") {
+		v.add(path, "either name or mac must be set")
+	}
+	if c.MAC != "" {
+		if _, err := net.ParseMAC(c.MAC); err != nil {
+			v.add(path+".mac", "invalid MAC address %q", c.MAC)
+		}
+	}
+	c.IPv4.validate(v, path+".ipv4", false)
+	c.IPv6.validate(v, path+".ipv6", true)
+	for i, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			v.add(fmt.Sprintf("%s.nameservers[%d]", path, i), "invalid IP address %q", ns)
+		}
+	}
+	for i, d := range c.SearchDomains {
+		if err := ValidateHostname(d); err != nil {
+			v.add(fmt.Sprintf("%s.search_domains[%d]", path, i), "invalid domain %q", d)
+		}
+	}
+	if c.MTU != 0 && (c.MTU < 68 || c.MTU > 65535) {
+		v.add(path+".mtu", "MTU must be between 68 and 65535")
+	}
+}
+
+func (c *IPConfig) validate(v *validator, path string, ipv6 bool) {
+	family, example := "IPv4", "192.168.1.10/24"
+	if ipv6 {
+		family, example = "IPv6", "2001:db8::10/64"
+	}
+	isFamily := func(ip net.IP) bool {
+		return ip != nil && (ip.To4() == nil) == ipv6
+	}
+	switch c.MethodOrDefault() {
+	case IPMethodStatic:
+		if c.Address == "" {
+			v.add(path+".address", "address is required for static method")
+		} else if ip, _, err := net.ParseCIDR(c.Address); err != nil || !isFamily(ip) {
+			v.add(path+".address", "address must be an %s address with a prefix length, e.g. %s", family, example)
+		}
+		if c.Gateway != "" && !isFamily(net.ParseIP(c.Gateway)) {
+			v.add(path+".gateway", "gateway must be an %s address", family)
+		}
+	case IPMethodDHCP, IPMethodOff:
+		if c.Address != "" {
+			v.add(path+".address", "address must only be set for static method")
+		}
+		if c.Gateway != "" {
+			v.add(path+".gateway", "gateway must only be set for static method")
+		}
+	default:
+		v.add(path+".method", "method must be one of: %s, %s, %s", IPMethodDHCP, IPMethodStatic, IPMethodOff)
+	}
+}
+
+func (c *WifiConfig) validate(v *validator, path string) {
+	if c.Name == "" {
+		v.add(path+".name", "Wi-Fi network name is required")
+	} else if len(c.Name) > 32 {
+		v.add(path+".name", "Wi-Fi network name must be at most 32 bytes long")
+	}
+	if c.Priority < 0 {
+		v.add(path+".priority", "priority must not be negative")
+	}
+	security := c.SecurityOrDefault()
+	switch security {
+	case WifiSecurityPSK:
+		if !v.secretRef(path+".password", c.Password) && !isWPAPassphrase(c.Password) {
+			v.add(path+".password", "WPA password must be 8-63 characters long or a 64 hex digits pre-shared key")
+		}
+	case WifiSecurityNone:
+		if c.Password != "" {
+			v.add(path+".password", "password must not be set for an open network")
+		}
+	case WifiSecurityWPAEAP:
+		switch c.EAP {
+		case WifiEAPPEAP, WifiEAPTTLS:
+		case "":
+			v.add(path+".eap", "EAP method is required for %s network", WifiSecurityWPAEAP)
+		default:
+			v.add(path+".eap", "EAP method must be one of: %s, %s", WifiEAPPEAP, WifiEAPTTLS)
+		}
+		if c.Identity == "" {
+			v.add(path+".identity", "identity is required for %s network", WifiSecurityWPAEAP)
+		}
+		if c.Password == "" {
+			v.add(path+".password", "password is required for %s network", WifiSecurityWPAEAP)
+		}
+		v.secretRef(path+".password", c.Password)
+		if c.Phase2 == "" {
+			v.add(path+".phase2", "phase2 authentication is required for %s network", WifiSecurityWPAEAP)
+		} else if !isWifiPhase2(c.Phase2) {
+			v.add(path+".phase2", "phase2 authentication must be one of: %s", strings.Join(wifiPhase2Methods, ", "))
+		}
+		if c.CACert != "" {
+			if block, _ := pem.Decode([]byte(c.CACert)); block == nil || block.Type != "CERTIFICATE" {
+				v.add(path+".ca_cert", "CA certificate must be PEM encoded")
+			}
+		}
+	default:
+		v.add(path+".security", "security must be one of: %s, %s, %s",
+			WifiSecurityPSK, WifiSecurityNone, WifiSecurityWPAEAP)
+	}
+	if security != WifiSecurityWPAEAP {
+		eapFields := []struct{ name, value string }{
+			{"eap", string(c.EAP)},
+			{"identity", c.Identity},
+			{"anonymous_identity", c.AnonymousIdentity},
+			{"ca_cert", c.CACert},
+			{"phase2", c.Phase2},
+		}
+		for _, f := range eapFields {
+			if f.value != "" {
+				v.add(path+"."+f.name, "%s must only be set for %s network", f.name, WifiSecurityWPAEAP)
+			}
+		}
+	}
+}
+
+// wifiPhase2Methods are the inner authentication methods of PEAP and TTLS supported by ConnMan.
+var wifiPhase2Methods = []string{"mschapv2", "mschap", "gtc", "pap", "md5"}
+
+func isWifiPhase2(method string) bool {
+	for _, m := range wifiPhase2Methods {
+		if strings.EqualFold(method, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWPAPassphrase checks that the password is a valid WPA passphrase or a hex encoded 256-bit pre-shared key.
+func isWPAPassphrase(password string) bool {
+	if len(password) == 64 {
+		for _, c := range strings.ToLower(password) {
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return false
+			}
+		}
+		return true
+	}
+	return len(password) >= 8 && len(password) <= 63
+}
+
+func (c *K3sConfig) validate(v *validator, path string) {
+	switch c.Role {
+	case ClusterInitRole:
+		if c.Server != "" {
+			v.add(path+".server", "server must not be set for %s role as it initialises a new cluster",
+				ClusterInitRole)
+		}
+	case ControlPlaneRole, WorkerRole:
+		if c.Server == "" {
+			v.add(path+".server", "server to join is required for %s role", c.Role)
+		} else if u, err := url.Parse(c.Server); err != nil || u.Scheme != "https" || u.Host == "" {
+			v.add(path+".server", "server must be an https URL, e.g. https://hostname:6443")
+		}
+	case "":
+		v.add(path+".role", "role is required")
+	default:
+		v.add(path+".role", "role must be one of: %s, %s, %s", ClusterInitRole, ControlPlaneRole, WorkerRole)
+	}
+	if c.Token == "" {
+		v.add(path+".token", "token is required")
+	}
+	v.secretRef(path+".token", c.Token)
+
+	keys := make([]string, 0, len(c.NodeLabels))
+	for key := range c.NodeLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := validateLabel(key, c.NodeLabels[key]); err != nil {
+			v.add(path+".node_labels."+key, "%v", err)
+		}
+	}
+	for i, taint := range c.NodeTaints {
+		if err := validateTaint(taint); err != nil {
+			v.add(fmt.Sprintf("%s.node_taints[%d]", path, i), "%v", err)
+		}
+	}
+	for i, component := range c.Disable {
+		if !contains(K3sDisableComponents, component) {
+			v.add(fmt.Sprintf("%s.disable[%d]", path, i), "component must be one of: %s",
+				strings.Join(K3sDisableComponents, ", "))
+		}
+	}
+	for _, args := range []struct {
+		name   string
+		values []string
+	}{
+		{"kubelet_args", c.KubeletArgs},
+		{"kube_apiserver_args", c.KubeAPIServerArgs},
+	} {
+		for i, arg := range args.values {
+			if strings.TrimLeft(arg, "-") == "" || strings.ContainsAny(arg, "\n\r") {
+				v.add(fmt.Sprintf("%s.%s[%d]", path, args.name, i), "invalid flag %q, e.g. max-pods=200", arg)
+			}
+		}
+	}
+	for _, ips := range []struct {
+		name   string
+		values []string
+	}{
+		{"node_ip", c.NodeIP},
+		{"node_external_ip", c.NodeExternalIP},
+	} {
+		if len(ips.values) > 2 {
+			v.add(path+"."+ips.name, "at most one IPv4 and one IPv6 address can be specified")
+		}
+		for i, ip := range ips.values {
+			if net.ParseIP(ip) == nil {
+				v.add(fmt.Sprintf("%s.%s[%d]", path, ips.name, i), "invalid IP address %q", ip)
+			}
+		}
+	}
+	for i, san := range c.TLSSAN {
+		if net.ParseIP(san) == nil && ValidateHostname(strings.TrimPrefix(san, "*.")) != nil {
+			v.add(fmt.Sprintf("%s.tls_san[%d]", path, i), "invalid host name or IP address %q", san)
+		}
+	}
+	keys = keys[:0]
+	for key := range c.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !k3sOptionRegexp.MatchString(key) {
+			v.add(path+".extra."+key, "invalid k3s option name, e.g. write-kubeconfig-mode")
+		}
+		for _, managed := range K3sManagedOptions {
+			if key == managed {
+				v.add(path+".extra."+key, "k3s option %s is managed by the OS config and can't be set in extra "+
+					"options", key)
+			}
+		}
+	}
+
+	if c.Role == WorkerRole {
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"disable", len(c.Disable) > 0},
+			{"kube_apiserver_args", len(c.KubeAPIServerArgs) > 0},
+			{"tls_san", len(c.TLSSAN) > 0},
+		} {
+			if opt.set {
+				v.add(path+"."+opt.name, "%s is only supported for %s and %s roles", opt.name,
+					ClusterInitRole, ControlPlaneRole)
+			}
+		}
+	}
+}
+
+// validateLabel checks that the key and value form a valid Kubernetes label.
+func validateLabel(key, value string) error {
+	prefix, name, ok := strings.Cut(key, "/")
+	if !ok {
+		prefix, name = "", key
+	} else if len(prefix) > 253 || ValidateHostname(prefix) != nil || strings.ToLower(prefix) != prefix {
+		return fmt.Errorf("invalid label key prefix %q, must be a lowercase DNS subdomain", prefix)
+	}
+	if !labelNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid label name %q, must be at most 63 alphanumeric characters, '-', '_' or '.'",
+			name)
+	}
+	if value != "" && !labelNameRegexp.MatchString(value) {
+		return fmt.Errorf("invalid label value %q, must be at most 63 alphanumeric characters, '-', '_' or '.'",
+			value)
+	}
+	return nil
+}
+
+// validateTaint checks that the taint is in the key[=value]:effect format.
+func validateTaint(taint string) error {
+	kv, effect, ok := strings.Cut(taint, ":")
+	if !ok || !contains(K3sTaintEffects, effect) {
+		return fmt.Errorf("invalid taint %q, must be in the key[=value]:effect format with effect one of: %s",
+			taint, strings.Join(K3sTaintEffects, ", "))
+	}
+	key, value, _ := strings.Cut(kv, "=")
+	if err := validateLabel(key, value); err != nil {
+		return fmt.Errorf("invalid taint %q: %w", taint, err)
+	}
+	return nil
+}
+
+func (c *WriteFileConfig) validate(v *validator, path string) {
+	if !filepath.IsAbs(c.Path) {
+		v.add(path+".path", "path must be absolute")
+	}
+	switch c.Encoding {
+	case "":
+	case FileEncodingBase64:
+		if _, err := base64.StdEncoding.DecodeString(c.Content); err != nil {
+			v.add(path+".content", "invalid base64 content: %v", err)
+		}
+	default:
+		v.add(path+".encoding", "encoding must be %s if set", FileEncodingBase64)
+	}
+	if c.Owner != "" {
+		user, group, hasGroup := strings.Cut(c.Owner, ":")
+		if user == "" || (hasGroup && group == "") {
+			v.add(path+".owner", "owner must be in the user[:group] form")
+		}
+	}
+	if c.Permissions != "" {
+		if perm, err := strconv.ParseUint(c.Permissions, 8, 32); err != nil || perm > 07777 {
+			v.add(path+".permissions", "permissions must be an octal number, e.g. 0644")
+		}
+	}
+}
+
+func (c *RunCommandConfig) validate(v *validator, path string) {
+	switch c.StageOrDefault() {
+	case BeforeK3sStage, AfterK3sStage:
+	default:
+		v.add(path+".stage", "stage must be one of: %s, %s", BeforeK3sStage, AfterK3sStage)
+	}
+	if strings.TrimSpace(c.Command) == "" {
+		v.add(path+".command", "command is required")
+	}
+	if timeout, err := c.TimeoutOrDefault(); err != nil || timeout <= 0 {
+		v.add(path+".timeout", "timeout must be a positive duration, e.g. 30s or 5m")
+	}
+}
+
+func (c *UserConfig) validate(v *validator, path string) {
+	switch {
+	case c.Name == "":
+		v.add(path+".name", "name is required")
+	case c.Name == "root":
+		v.add(path+".name", "root user can't be managed")
+	case c.Name == LoginUsername:
+		v.add(path+".name", "%s user is configured with the top-level password and ssh_authorized_keys", LoginUsername)
+	case !usernameRegexp.MatchString(c.Name):
+		v.add(path+".name", "name must start with a lowercase letter or underscore and contain only lowercase "+
+			"letters, digits, underscores, and hyphens (max 32 characters)")
+	}
+	if c.UID != 0 && (c.UID < MinUserUID || c.UID > MaxUserUID) {
+		v.add(path+".uid", "uid must be between %d and %d", MinUserUID, MaxUserUID)
+	}
+	for i, g := range c.Groups {
+		if !usernameRegexp.MatchString(g) {
+			v.add(fmt.Sprintf("%s.groups[%d]", path, i), "invalid group name %q", g)
+		}
+	}
+	if c.Shell != "" && !filepath.IsAbs(c.Shell) {
+		v.add(path+".shell", "shell must be an absolute path")
+	}
+	if c.Password != "" && !v.secretRef(path+".password", c.Password) && !strings.HasPrefix(c.Password, "$") {
+		v.add(path+".password", "password must be hashed, e.g. with mkpasswd -m sha-512")
+	}
+	for i, key := range c.SSHAuthorizedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			v.add(fmt.Sprintf("%s.ssh_authorized_keys[%d]", path, i), "invalid SSH public key: %v", err)
+		}
+	}
+	switch c.DoasOrDefault() {
+	case DoasNone, DoasNoPass:
+	case DoasPassword:
+		if c.Password == "" {
+			v.add(path+".doas", "doas with password requires the user password to be set")
+		}
+	default:
+		v.add(path+".doas", "doas must be one of: %s, %s, %s", DoasNone, DoasPassword, DoasNoPass)
+	}
+}
+
+func (c *SystemConfig) validate(v *validator, path string) {
+	if c.Timezone != "" && !timezoneRegexp.MatchString(c.Timezone) {
+		v.add(path+".timezone", "invalid time zone %q, must be a name from the IANA database, e.g. Europe/London",
+			c.Timezone)
+	}
+	if c.Locale != "" && !localeRegexp.MatchString(c.Locale) {
+		v.add(path+".locale", "invalid locale %q, e.g. en_GB.UTF-8", c.Locale)
+	}
+	keys := make([]string, 0, len(c.Sysctl))
+	for key := range c.Sysctl {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !sysctlRegexp.MatchString(key) {
+			v.add(path+".sysctl."+key, "invalid kernel parameter name")
+		}
+		if value := c.Sysctl[key]; strings.TrimSpace(value) == "" || strings.ContainsAny(value, "\n\r") {
+			v.add(path+".sysctl."+key, "value must be non-empty and fit on a single line")
+		}
+	}
+	for i, module := range c.KernelModules {
+		if !kernelModuleRegexp.MatchString(module) {
+			v.add(fmt.Sprintf("%s.kernel_modules[%d]", path, i), "invalid kernel module name %q", module)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"strconv"
+)
+
+// CurrentVersion is the version of the config schema written by this release. Bump it and add a migration
+// when the format changes in a way that older agents can't interpret.
+const CurrentVersion = 3
+
+const versionKey = "version"
+
+// migrations upgrade a config document in place from version i to version i+1 where i is the index of the migration.
+var migrations = []func(doc *yaml.Node) error{
+	// Configs without a version were created before the version field was introduced and have the same format.
+	func(*yaml.Node) error { return nil },
+	migrateSingleWifi,
+	// Version 3 adds secret references that version 2 agents would apply literally, e.g. set a sealed value as
+	// the password. The format is otherwise the same so the version bump only makes the older agents reject them.
+	func(*yaml.Node) error { return nil },
+}
+
+func init() {
+	if len(migrations) != CurrentVersion {
+		panic(fmt.Sprintf("config migrations must upgrade documents to version %d", CurrentVersion))
+	}
+}
+
+// migrate upgrades the config document to the current version. It returns true if the document has been changed.
+func migrate(doc *yaml.Node) (bool, error) {
+	if doc.Kind != yaml.MappingNode {
+		return false, fmt.Errorf("config must be a YAML mapping")
+	}
+	version, err := documentVersion(doc)
+	if err != nil {
+		return false, err
+	}
+	if version > CurrentVersion {
+		return false, fmt.Errorf("config version %d is newer than the latest supported version %d, "+
+			"upgrade Home Cloud OS to use this config", version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return false, nil
+	}
+	for v := version; v < CurrentVersion; v++ {
+		if err := migrations[v](doc); err != nil {
+			return false, fmt.Errorf("unable to upgrade config from version %d to %d: %w", v, v+1, err)
+		}
+	}
+	setMappingValue(doc, versionKey, &yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!int",
+		Value: strconv.Itoa(CurrentVersion),
+	})
+	return true, nil
+}
+
+// documentVersion returns the version of the config document or 0 if the version is not specified.
+func documentVersion(doc *yaml.Node) (int, error) {
+	node := mappingValue(doc, versionKey)
+	if node == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(node.Value)
+	if err != nil || node.Kind != yaml.ScalarNode || version < 1 {
+		return 0, fmt.Errorf("invalid config version %q, must be a positive integer", node.Value)
+	}
+	return version, nil
+}
+
+// mappingValue returns the value of the key in the mapping node or nil if the key is not found.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue replaces the value of the key in the mapping node or prepends the key if it's not found.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	mapping.Content = append([]*yaml.Node{keyNode, value}, mapping.Content...)
+}
+
+// migrateSingleWifi converts the single Wi-Fi network mapping of version 1 to a list of networks.
+func migrateSingleWifi(doc *yaml.Node) error {
+	network := mappingValue(doc, "network")
+	if network == nil || network.Kind != yaml.MappingNode {
+		return nil
+	}
+	wifi := mappingValue(network, "wifi")
+	if wifi == nil || wifi.Kind != yaml.MappingNode {
+		return nil
+	}
+	networks := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	// Version 1 agents ignored the network if neither its name nor password was set.
+	for _, key := range []string{"name", "password"} {
+		if v := mappingValue(wifi, key); v != nil && v.Value != "" {
+			networks.Content = []*yaml.Node{wifi}
+			break
+		}
+	}
+	setMappingValue(network, "wifi", networks)
+	return nil
+}
@@ -1,9 +1,18 @@
 package ssh
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/mitchellh/go-homedir"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // AuthorizedKeyFromPrivate creates an SSH public authorized key corresponding to the private key.
@@ -18,3 +27,75 @@ func AuthorizedKeyFromPrivate(key []byte) (string, error) {
 	}
 	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
 }
+
+// Client is an SSH client connected to a remote host.
+type Client struct {
+	*ssh.Client
+}
+
+// Dial connects to the SSH server at addr (host or host:port) as the user authenticating with the private key.
+// The host key is verified against the user's ~/.ssh/known_hosts file.
+func Dial(addr, user string, key []byte) (*Client, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH private key: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	hostKeyCallback, err := knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			return nil, fmt.Errorf("%w. Please verify the host key and add it to known hosts, "+
+				"e.g. using `ssh-keyscan %s >> ~/.ssh/known_hosts`", err, host)
+		}
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+func knownHostsCallback() (ssh.HostKeyCallback, error) {
+	path, err := homedir.Expand("~/.ssh/known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Create an empty file so that unknown hosts are reported with a hint how to add them.
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return knownhosts.New(path)
+}
+
+// Run runs the command on the remote host with the optional stdin and returns its combined output.
+func (c *Client) Run(cmd string, stdin io.Reader) (string, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return "", err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer session.Close()
+	session.Stdin = stdin
+	var out bytes.Buffer
+	session.Stdout = &out
+	session.Stderr = &out
+	if err := session.Run(cmd); err != nil {
+		return out.String(), fmt.Errorf("command failed: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}